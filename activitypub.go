@@ -0,0 +1,966 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Delvoid/chirpy/database"
+)
+
+const (
+	activityStreamsContext = "https://www.w3.org/ns/activitystreams"
+	securityContext        = "https://w3id.org/security/v1"
+	publicAddress          = "https://www.w3.org/ns/activitystreams#Public"
+	activityContentType    = "application/activity+json"
+
+	// maxActivitySize caps the size of ActivityPub documents we read.
+	maxActivitySize = 1 << 20
+)
+
+var apClient = newAPClient(false)
+
+// newAPClient returns the client used for requests to other servers. Those
+// URLs come from remote documents, so unless allowPrivate is set it refuses to
+// connect to loopback, private and link-local addresses. The check runs on
+// the resolved address of every connection, redirects included.
+func newAPClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("refusing to connect to non-public address %s", host)
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsUnspecified()
+}
+
+// Deliveries run in the background; shutdown waits for them through
+// deliveries and cancels stragglers with stopDeliveries.
+var (
+	deliveries                  sync.WaitGroup
+	pendingDeliveries           atomic.Int64
+	deliveryCtx, stopDeliveries = context.WithCancel(context.Background())
+)
+
+type apActor struct {
+	Context           []string    `json:"@context"`
+	ID                string      `json:"id"`
+	Type              string      `json:"type"`
+	PreferredUsername string      `json:"preferredUsername"`
+	Name              string      `json:"name"`
+	URL               string      `json:"url"`
+	Inbox             string      `json:"inbox"`
+	Outbox            string      `json:"outbox"`
+	Followers         string      `json:"followers"`
+	Following         string      `json:"following"`
+	PublicKey         apPublicKey `json:"publicKey"`
+}
+
+type apPublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type apNote struct {
+	Context      string        `json:"@context,omitempty"`
+	ID           string        `json:"id"`
+	Type         string        `json:"type"`
+	AttributedTo string        `json:"attributedTo"`
+	Content      string        `json:"content"`
+	URL          string        `json:"url,omitempty"`
+	Published    string        `json:"published,omitempty"`
+	To           []string      `json:"to,omitempty"`
+	Cc           []string      `json:"cc,omitempty"`
+	Likes        *apCollection `json:"likes,omitempty"`
+}
+
+type apActivity struct {
+	Context   string      `json:"@context,omitempty"`
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Actor     string      `json:"actor"`
+	Object    interface{} `json:"object"`
+	Published string      `json:"published,omitempty"`
+	To        []string    `json:"to,omitempty"`
+	Cc        []string    `json:"cc,omitempty"`
+}
+
+type apCollection struct {
+	Context      string        `json:"@context,omitempty"`
+	ID           string        `json:"id,omitempty"`
+	Type         string        `json:"type"`
+	TotalItems   int           `json:"totalItems"`
+	OrderedItems []interface{} `json:"orderedItems,omitempty"`
+}
+
+// incomingActivity is the subset of an activity we need to route it. Object
+// may be either an IRI or an embedded object.
+type incomingActivity struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+type remoteActor struct {
+	ID        string `json:"id"`
+	Inbox     string `json:"inbox"`
+	Endpoints struct {
+		SharedInbox string `json:"sharedInbox"`
+	} `json:"endpoints"`
+}
+
+type webfingerResponse struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases,omitempty"`
+	Links   []webfingerLink `json:"links"`
+}
+
+type webfingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href,omitempty"`
+}
+
+type followRequest struct {
+	Account string `json:"account"`
+}
+
+func webfingerHandler(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+	if resource == "" {
+		respondWithError(w, "Missing resource parameter", http.StatusBadRequest)
+		return
+	}
+
+	base := baseURL()
+	host := strings.TrimPrefix(strings.TrimPrefix(base, "https://"), "http://")
+	userID, err := resolveLocalResource(resource, base, host)
+	if err != nil {
+		respondWithError(w, "Resource not found", http.StatusNotFound)
+		return
+	}
+
+	if _, err := database.GetUserByID(r.Context(), userID); err != nil {
+		respondWithError(w, "Resource not found", http.StatusNotFound)
+		return
+	}
+
+	actor := actorURL(base, userID)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	respondWithContentType(w, webfingerResponse{
+		Subject: fmt.Sprintf("acct:%d@%s", userID, host),
+		Aliases: []string{actor},
+		Links: []webfingerLink{
+			{Rel: "self", Type: activityContentType, Href: actor},
+		},
+	}, "application/jrd+json", http.StatusOK)
+}
+
+// resolveLocalResource maps a WebFinger resource, either acct:ID@host or an
+// actor URL, to a local user ID.
+func resolveLocalResource(resource, base, host string) (int, error) {
+	if strings.HasPrefix(resource, base+"/ap/users/") {
+		return strconv.Atoi(strings.TrimPrefix(resource, base+"/ap/users/"))
+	}
+
+	account, found := strings.CutPrefix(resource, "acct:")
+	if !found {
+		return 0, errors.New("unsupported resource")
+	}
+	name, domain, ok := strings.Cut(account, "@")
+	if !ok || domain != host {
+		return 0, errors.New("unknown domain")
+	}
+	return strconv.Atoi(name)
+}
+
+func actorHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := localUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	keyPem, err := database.GetOrCreateActorKey(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, "Failed to load actor key", http.StatusInternalServerError)
+		return
+	}
+	key, err := parsePrivateKeyPEM(keyPem)
+	if err != nil {
+		respondWithError(w, "Failed to load actor key", http.StatusInternalServerError)
+		return
+	}
+	publicPem, err := encodePublicKeyPEM(&key.PublicKey)
+	if err != nil {
+		respondWithError(w, "Failed to load actor key", http.StatusInternalServerError)
+		return
+	}
+
+	base := baseURL()
+	actor := actorURL(base, userID)
+	respondWithContentType(w, apActor{
+		Context:           []string{activityStreamsContext, securityContext},
+		ID:                actor,
+		Type:              "Person",
+		PreferredUsername: strconv.Itoa(userID),
+		Name:              authorName(userID),
+		URL:               fmt.Sprintf("%s/api/chirps?author_id=%d", base, userID),
+		Inbox:             actor + "/inbox",
+		Outbox:            actor + "/outbox",
+		Followers:         actor + "/followers",
+		Following:         actor + "/following",
+		PublicKey: apPublicKey{
+			ID:           actor + "#main-key",
+			Owner:        actor,
+			PublicKeyPem: publicPem,
+		},
+	}, activityContentType, http.StatusOK)
+}
+
+func outboxHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := localUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	chirps, err := database.GetChirpsByAuthorID(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, "Failed to retrieve chirps", http.StatusInternalServerError)
+		return
+	}
+	chirps = sortChirps(chirps, "desc")
+
+	base := baseURL()
+	items := make([]interface{}, 0, len(chirps))
+	for _, chirp := range chirps {
+		items = append(items, createActivity(r.Context(), base, chirp))
+	}
+
+	respondWithContentType(w, apCollection{
+		Context:      activityStreamsContext,
+		ID:           actorURL(base, userID) + "/outbox",
+		Type:         "OrderedCollection",
+		TotalItems:   len(items),
+		OrderedItems: items,
+	}, activityContentType, http.StatusOK)
+}
+
+func followersHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := localUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	followers, err := database.GetFollowers(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, "Failed to retrieve followers", http.StatusInternalServerError)
+		return
+	}
+
+	items := make([]interface{}, 0, len(followers))
+	for _, follower := range followers {
+		items = append(items, follower.ActorID)
+	}
+
+	respondWithContentType(w, apCollection{
+		Context:      activityStreamsContext,
+		ID:           actorURL(baseURL(), userID) + "/followers",
+		Type:         "OrderedCollection",
+		TotalItems:   len(items),
+		OrderedItems: items,
+	}, activityContentType, http.StatusOK)
+}
+
+func followingHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := localUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	following, err := database.GetFollowing(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, "Failed to retrieve following", http.StatusInternalServerError)
+		return
+	}
+
+	items := make([]interface{}, 0, len(following))
+	for _, followee := range following {
+		if followee.Accepted {
+			items = append(items, followee.ActorID)
+		}
+	}
+
+	respondWithContentType(w, apCollection{
+		Context:      activityStreamsContext,
+		ID:           actorURL(baseURL(), userID) + "/following",
+		Type:         "OrderedCollection",
+		TotalItems:   len(items),
+		OrderedItems: items,
+	}, activityContentType, http.StatusOK)
+}
+
+func noteHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, "Invalid chirp ID", http.StatusBadRequest)
+		return
+	}
+
+	chirp, err := database.GetChirpByID(r.Context(), chirpID)
+	if err != nil {
+		if errors.Is(err, database.ErrChirpNotFound) {
+			respondWithError(w, "Chirp not found", http.StatusNotFound)
+		} else {
+			respondWithError(w, "Failed to retrieve chirp", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	note := chirpNote(r.Context(), baseURL(), chirp)
+	note.Context = activityStreamsContext
+	respondWithContentType(w, note, activityContentType, http.StatusOK)
+}
+
+// inboxReadHandler lets a local user read the notes delivered to their inbox.
+func inboxReadHandler(jwtKeys *keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := validateToken(r, jwtKeys)
+		if err != nil {
+			respondWithError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		pathID, err := strconv.Atoi(r.PathValue("userID"))
+		if err != nil {
+			respondWithError(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		if pathID != userID {
+			respondWithError(w, "Not authorized to read this inbox", http.StatusForbidden)
+			return
+		}
+
+		notes, err := database.GetRemoteNotesForUser(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, "Failed to retrieve inbox", http.StatusInternalServerError)
+			return
+		}
+
+		items := make([]interface{}, 0, len(notes))
+		for _, note := range notes {
+			items = append(items, apNote{
+				ID:           note.ID,
+				Type:         "Note",
+				AttributedTo: note.AttributedTo,
+				Content:      note.Content,
+				URL:          note.URL,
+				Published:    note.Published.UTC().Format(time.RFC3339),
+			})
+		}
+
+		respondWithContentType(w, apCollection{
+			Context:      activityStreamsContext,
+			ID:           actorURL(baseURL(), userID) + "/inbox",
+			Type:         "OrderedCollection",
+			TotalItems:   len(items),
+			OrderedItems: items,
+		}, activityContentType, http.StatusOK)
+	}
+}
+
+func inboxHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := localUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxActivitySize))
+	if err != nil {
+		respondWithError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	signer, err := verifyRequest(r, body)
+	if err != nil {
+		respondWithError(w, "Invalid signature: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var activity incomingActivity
+	if err := json.Unmarshal(body, &activity); err != nil {
+		respondWithError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if activity.Actor != signer {
+		respondWithError(w, "Signature does not belong to actor", http.StatusUnauthorized)
+		return
+	}
+
+	base := baseURL()
+	localActor := actorURL(base, userID)
+
+	switch activity.Type {
+	case "Follow":
+		if objectID(activity.Object) != localActor {
+			respondWithError(w, "Follow is not for this actor", http.StatusBadRequest)
+			return
+		}
+
+		var remote remoteActor
+		if err := fetchActivityJSON(r.Context(), activity.Actor, &remote); err != nil {
+			respondWithError(w, "Failed to fetch actor", http.StatusBadGateway)
+			return
+		}
+		if remote.ID != activity.Actor {
+			respondWithError(w, "Actor document does not match actor", http.StatusBadRequest)
+			return
+		}
+
+		err := database.AddFollower(r.Context(), userID, database.Follower{ActorID: remote.ID, Inbox: remote.Inbox})
+		if err != nil {
+			respondWithError(w, "Failed to save follower", http.StatusInternalServerError)
+			return
+		}
+
+		deliver(r.Context(), userID, base, apActivity{
+			Context: activityStreamsContext,
+			ID:      localActor + "#accepts/" + randomID(),
+			Type:    "Accept",
+			Actor:   localActor,
+			Object:  json.RawMessage(body),
+		}, []string{remote.Inbox})
+
+	case "Undo":
+		var inner incomingActivity
+		if err := json.Unmarshal(activity.Object, &inner); err != nil {
+			respondWithError(w, "Undo must embed the undone activity", http.StatusBadRequest)
+			return
+		}
+		if inner.Actor != activity.Actor {
+			respondWithError(w, "Cannot undo another actor's activity", http.StatusForbidden)
+			return
+		}
+
+		switch inner.Type {
+		case "Follow":
+			err := database.RemoveFollower(r.Context(), userID, activity.Actor)
+			if err != nil && !errors.Is(err, database.ErrNotFollowing) {
+				respondWithError(w, "Failed to remove follower", http.StatusInternalServerError)
+				return
+			}
+		case "Like":
+			if chirpID, ok := localChirpID(base, objectID(inner.Object)); ok {
+				if err := database.RemoveLike(r.Context(), chirpID, activity.Actor); err != nil {
+					respondWithError(w, "Failed to remove like", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+	case "Like":
+		chirpID, ok := localChirpID(base, objectID(activity.Object))
+		if !ok {
+			respondWithError(w, "Like is not for a local chirp", http.StatusBadRequest)
+			return
+		}
+
+		err := database.AddLike(r.Context(), chirpID, activity.Actor)
+		if err != nil {
+			if errors.Is(err, database.ErrChirpNotFound) {
+				respondWithError(w, "Chirp not found", http.StatusNotFound)
+			} else {
+				respondWithError(w, "Failed to save like", http.StatusInternalServerError)
+			}
+			return
+		}
+
+	case "Create":
+		var note apNote
+		if err := json.Unmarshal(activity.Object, &note); err != nil || note.Type != "Note" {
+			// Only notes are supported; anything else is ignored.
+			break
+		}
+		if note.AttributedTo != activity.Actor {
+			respondWithError(w, "Note is not attributed to actor", http.StatusForbidden)
+			return
+		}
+
+		followers, err := database.GetLocalFollowersOf(r.Context(), activity.Actor)
+		if err != nil {
+			respondWithError(w, "Failed to look up followers", http.StatusInternalServerError)
+			return
+		}
+		addressed := containsString(note.To, localActor) || containsString(note.Cc, localActor)
+		if !containsInt(followers, userID) && !addressed {
+			break
+		}
+
+		published, err := time.Parse(time.RFC3339, note.Published)
+		if err != nil {
+			published = time.Now().UTC()
+		}
+
+		err = database.SaveRemoteNote(r.Context(), database.RemoteNote{
+			ID:           note.ID,
+			AttributedTo: note.AttributedTo,
+			Content:      note.Content,
+			URL:          note.URL,
+			Published:    published,
+			Recipients:   []int{userID},
+		})
+		if err != nil {
+			respondWithError(w, "Failed to save note", http.StatusInternalServerError)
+			return
+		}
+
+	case "Accept":
+		var inner incomingActivity
+		if err := json.Unmarshal(activity.Object, &inner); err != nil {
+			inner.ID = objectID(activity.Object)
+		}
+
+		err := database.AcceptFollowing(r.Context(), inner.ID, activity.Actor)
+		if err != nil && !errors.Is(err, database.ErrNotFollowing) {
+			respondWithError(w, "Failed to accept follow", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// followHandler makes the authenticated user follow a remote account given as
+// user@host or an actor URL.
+func followHandler(jwtKeys *keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := validateToken(r, jwtKeys)
+		if err != nil {
+			respondWithError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		var req followRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Account == "" {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		actorID, err := resolveAccount(r, req.Account)
+		if err != nil {
+			respondWithError(w, "Failed to resolve account: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		var remote remoteActor
+		if err := fetchActivityJSON(r.Context(), actorID, &remote); err != nil {
+			respondWithError(w, "Failed to fetch actor", http.StatusBadGateway)
+			return
+		}
+		// The document must describe the actor it was fetched from, or one
+		// host could stand in for an actor on another.
+		if remote.ID != actorID || remote.Inbox == "" {
+			respondWithError(w, "Actor document does not match account", http.StatusBadGateway)
+			return
+		}
+
+		base := baseURL()
+		localActor := actorURL(base, userID)
+		followee := database.Followee{
+			ActorID:    remote.ID,
+			Inbox:      remote.Inbox,
+			ActivityID: localActor + "#follows/" + randomID(),
+		}
+
+		err = database.AddFollowing(r.Context(), userID, followee)
+		if err != nil {
+			respondWithError(w, "Failed to save follow", http.StatusInternalServerError)
+			return
+		}
+
+		deliver(r.Context(), userID, base, apActivity{
+			Context: activityStreamsContext,
+			ID:      followee.ActivityID,
+			Type:    "Follow",
+			Actor:   localActor,
+			Object:  remote.ID,
+		}, []string{remote.Inbox})
+
+		respondWithJSON(w, followee, http.StatusAccepted)
+	}
+}
+
+func unfollowHandler(jwtKeys *keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := validateToken(r, jwtKeys)
+		if err != nil {
+			respondWithError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		var req followRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Account == "" {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		actorID, err := resolveAccount(r, req.Account)
+		if err != nil {
+			respondWithError(w, "Failed to resolve account: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		followee, err := database.RemoveFollowing(r.Context(), userID, actorID)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFollowing) {
+				respondWithError(w, "Not following this account", http.StatusNotFound)
+			} else {
+				respondWithError(w, "Failed to remove follow", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		base := baseURL()
+		localActor := actorURL(base, userID)
+		deliver(r.Context(), userID, base, apActivity{
+			Context: activityStreamsContext,
+			ID:      localActor + "#undos/" + randomID(),
+			Type:    "Undo",
+			Actor:   localActor,
+			Object: apActivity{
+				ID:     followee.ActivityID,
+				Type:   "Follow",
+				Actor:  localActor,
+				Object: followee.ActorID,
+			},
+		}, []string{followee.Inbox})
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// resolveAccount turns user@host (optionally prefixed with @ or acct:) into an
+// actor URL using WebFinger. Actor URLs are returned unchanged.
+func resolveAccount(r *http.Request, account string) (string, error) {
+	if strings.HasPrefix(account, "https://") || strings.HasPrefix(account, "http://") {
+		return account, nil
+	}
+
+	account = strings.TrimPrefix(strings.TrimPrefix(account, "acct:"), "@")
+	_, host, ok := strings.Cut(account, "@")
+	if !ok || host == "" {
+		return "", errors.New("account must be user@host")
+	}
+
+	var lastErr error
+	// Local development instances usually run without TLS.
+	for _, scheme := range []string{"https", "http"} {
+		endpoint := fmt.Sprintf("%s://%s/.well-known/webfinger?resource=%s",
+			scheme, host, url.QueryEscape("acct:"+account))
+
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, endpoint, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Accept", "application/jrd+json")
+
+		resp, err := apClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var jrd webfingerResponse
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxActivitySize)).Decode(&jrd)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("webfinger returned %s", resp.Status)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		for _, link := range jrd.Links {
+			if link.Rel == "self" && (link.Type == activityContentType || strings.Contains(link.Type, "activitystreams")) {
+				return link.Href, nil
+			}
+		}
+		return "", errors.New("no ActivityPub actor for account")
+	}
+
+	return "", lastErr
+}
+
+// federateChirp delivers a Create for a new chirp to the author's followers.
+func federateChirp(ctx context.Context, base string, chirp database.Chirp) {
+	inboxes, err := followerInboxes(ctx, chirp.AuthorID)
+	if err != nil || len(inboxes) == 0 {
+		return
+	}
+	deliver(ctx, chirp.AuthorID, base, createActivity(ctx, base, chirp), inboxes)
+}
+
+// federateDelete tells the author's followers that a chirp is gone.
+func federateDelete(ctx context.Context, base string, chirp database.Chirp) {
+	inboxes, err := followerInboxes(ctx, chirp.AuthorID)
+	if err != nil || len(inboxes) == 0 {
+		return
+	}
+
+	actor := actorURL(base, chirp.AuthorID)
+	noteID := noteURL(base, chirp.ID)
+	deliver(ctx, chirp.AuthorID, base, apActivity{
+		Context: activityStreamsContext,
+		ID:      noteID + "#delete",
+		Type:    "Delete",
+		Actor:   actor,
+		Object:  map[string]string{"id": noteID, "type": "Tombstone"},
+		To:      []string{publicAddress},
+		Cc:      []string{actor + "/followers"},
+	}, inboxes)
+}
+
+func followerInboxes(ctx context.Context, userID int) ([]string, error) {
+	followers, err := database.GetFollowers(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	inboxes := make([]string, 0, len(followers))
+	for _, follower := range followers {
+		if !containsString(inboxes, follower.Inbox) {
+			inboxes = append(inboxes, follower.Inbox)
+		}
+	}
+	return inboxes, nil
+}
+
+// deliver POSTs a signed activity to each inbox in the background, retrying
+// transient failures a few times.
+func deliver(ctx context.Context, userID int, base string, activity interface{}, inboxes []string) {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		log.Printf("Error marshalling activity: %s", err)
+		return
+	}
+
+	keyPem, err := database.GetOrCreateActorKey(ctx, userID)
+	if err != nil {
+		log.Printf("Error loading actor key for user %d: %s", userID, err)
+		return
+	}
+	key, err := parsePrivateKeyPEM(keyPem)
+	if err != nil {
+		log.Printf("Error parsing actor key for user %d: %s", userID, err)
+		return
+	}
+	keyID := actorURL(base, userID) + "#main-key"
+
+	for _, inbox := range inboxes {
+		deliveries.Add(1)
+		pendingDeliveries.Add(1)
+		go func(inbox string) {
+			defer deliveries.Done()
+			defer pendingDeliveries.Add(-1)
+
+			backoff := time.Second
+			for attempt := 1; attempt <= 3; attempt++ {
+				req, err := http.NewRequestWithContext(deliveryCtx, http.MethodPost, inbox, bytes.NewReader(body))
+				if err != nil {
+					log.Printf("Error delivering to %s: %s", inbox, err)
+					return
+				}
+				req.Header.Set("Content-Type", activityContentType)
+				if err := signRequest(req, body, keyID, key); err != nil {
+					log.Printf("Error signing delivery to %s: %s", inbox, err)
+					return
+				}
+
+				resp, err := apClient.Do(req)
+				if err == nil {
+					resp.Body.Close()
+					if resp.StatusCode < 300 {
+						return
+					}
+					err = fmt.Errorf("inbox returned %s", resp.Status)
+					if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+						log.Printf("Error delivering to %s: %s", inbox, err)
+						return
+					}
+				}
+
+				log.Printf("Error delivering to %s (attempt %d): %s", inbox, attempt, err)
+				select {
+				case <-time.After(backoff):
+				case <-deliveryCtx.Done():
+					return
+				}
+				backoff *= 4
+			}
+		}(inbox)
+	}
+}
+
+// waitForDeliveries blocks until background deliveries finish, cancelling
+// them if ctx expires first.
+func waitForDeliveries(ctx context.Context) error {
+	if pendingDeliveries.Load() == 0 {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		deliveries.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		stopDeliveries()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func createActivity(ctx context.Context, base string, chirp database.Chirp) apActivity {
+	note := chirpNote(ctx, base, chirp)
+	return apActivity{
+		ID:        note.ID + "#create",
+		Type:      "Create",
+		Actor:     note.AttributedTo,
+		Object:    note,
+		Published: note.Published,
+		To:        note.To,
+		Cc:        note.Cc,
+	}
+}
+
+func chirpNote(ctx context.Context, base string, chirp database.Chirp) apNote {
+	actor := actorURL(base, chirp.AuthorID)
+	note := apNote{
+		ID:           noteURL(base, chirp.ID),
+		Type:         "Note",
+		AttributedTo: actor,
+		Content:      "<p>" + html.EscapeString(chirp.Body) + "</p>",
+		URL:          chirpPermalink(base, chirp.ID),
+		To:           []string{publicAddress},
+		Cc:           []string{actor + "/followers"},
+	}
+	if !chirp.CreatedAt.IsZero() {
+		note.Published = chirp.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	if likes, err := database.CountLikes(ctx, chirp.ID); err == nil {
+		note.Likes = &apCollection{Type: "Collection", TotalItems: likes}
+	}
+	return note
+}
+
+// localUserFromPath parses the {userID} path value and checks the user
+// exists, writing an error response if not.
+func localUserFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	_, err = database.GetUserByID(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			respondWithError(w, "User not found", http.StatusNotFound)
+		} else {
+			respondWithError(w, "Failed to retrieve user", http.StatusInternalServerError)
+		}
+		return 0, false
+	}
+
+	return userID, true
+}
+
+func localChirpID(base, objectID string) (int, bool) {
+	idStr, found := strings.CutPrefix(objectID, base+"/ap/chirps/")
+	if !found {
+		return 0, false
+	}
+	chirpID, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, false
+	}
+	return chirpID, true
+}
+
+// objectID returns the id of an activity object given either as an IRI or an
+// embedded object.
+func objectID(raw json.RawMessage) string {
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return id
+	}
+
+	var object struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(raw, &object); err == nil {
+		return object.ID
+	}
+	return ""
+}
+
+func actorURL(base string, userID int) string {
+	return fmt.Sprintf("%s/ap/users/%d", base, userID)
+}
+
+func noteURL(base string, chirpID int) string {
+	return fmt.Sprintf("%s/ap/chirps/%d", base, chirpID)
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testInstanceEnv makes the test binary run main instead of the tests, so
+// each federation test instance is a real Chirpy process with its own
+// database and public URL.
+const testInstanceEnv = "CHIRPY_TEST_INSTANCE"
+
+// instance is a Chirpy server started by startInstance.
+type instance struct {
+	t    *testing.T
+	base string
+	host string
+}
+
+func startInstance(t *testing.T) *instance {
+	t.Helper()
+
+	// Reserve a free port; the child binds it again straight away.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := ln.Addr().String()
+	ln.Close()
+
+	dir := t.TempDir()
+	base := "http://" + host
+	cmd := exec.Command(os.Args[0],
+		"-addr", host,
+		"-public-url", base,
+		"-data", filepath.Join(dir, "database.json"),
+		"-env-file", filepath.Join(dir, ".env"),
+		"-federation-allow-private",
+		"-rate-limit=false",
+		"-bcrypt-cost", "4",
+		"-log-level", "error",
+	)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), testInstanceEnv+"=1", "JWT_SECRET=test-secret", "POLKA_API_KEY=test-polka-key")
+	var logs bytes.Buffer
+	cmd.Stdout = &logs
+	cmd.Stderr = &logs
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("%s log:\n%s", host, logs.String())
+		}
+	})
+
+	inst := &instance{t: t, base: base, host: host}
+	inst.eventually("instance to start", func() bool {
+		resp, err := http.Get(base + "/api/livez")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+	return inst
+}
+
+// do sends a JSON request and decodes the JSON response into out, if given.
+func (inst *instance) do(method, path, token string, body, out interface{}) int {
+	inst.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			inst.t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, inst.base+path, reader)
+	if err != nil {
+		inst.t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		inst.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			inst.t.Fatalf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// signUp creates a user and returns their ID and access token.
+func (inst *instance) signUp(email string) (int, string) {
+	inst.t.Helper()
+
+	credentials := map[string]string{"email": email, "password": "blue sky meth lab"}
+	if status := inst.do("POST", "/api/users", "", credentials, nil); status != http.StatusCreated {
+		inst.t.Fatalf("sign up on %s: status %d", inst.host, status)
+	}
+	var login struct {
+		ID    int    `json:"id"`
+		Token string `json:"token"`
+	}
+	if status := inst.do("POST", "/api/login", "", credentials, &login); status != http.StatusOK {
+		inst.t.Fatalf("log in on %s: status %d", inst.host, status)
+	}
+	return login.ID, login.Token
+}
+
+func (inst *instance) eventually(what string, cond func() bool) {
+	inst.t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			inst.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (inst *instance) collection(path, token string) []json.RawMessage {
+	var c struct {
+		OrderedItems []json.RawMessage `json:"orderedItems"`
+	}
+	inst.do("GET", path, token, nil, &c)
+	return c.OrderedItems
+}
+
+func TestFederationBetweenInstances(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts two server processes")
+	}
+
+	alice := startInstance(t)
+	bob := startInstance(t)
+	aliceID, aliceToken := alice.signUp("alice@example.com")
+	bobID, bobToken := bob.signUp("bob@example.com")
+	aliceActor := fmt.Sprintf("%s/ap/users/%d", alice.base, aliceID)
+	bobActor := fmt.Sprintf("%s/ap/users/%d", bob.base, bobID)
+	bobAccount := fmt.Sprintf("%d@%s", bobID, bob.host)
+
+	var jrd webfingerResponse
+	status := bob.do("GET", "/.well-known/webfinger?resource="+url.QueryEscape("acct:"+bobAccount), "", nil, &jrd)
+	if status != http.StatusOK || jrd.Subject != "acct:"+bobAccount {
+		t.Fatalf("webfinger: status %d, subject %q", status, jrd.Subject)
+	}
+	if len(jrd.Links) != 1 || jrd.Links[0].Href != bobActor {
+		t.Fatalf("webfinger links = %+v, want self link to %s", jrd.Links, bobActor)
+	}
+
+	// Alice follows Bob: the signed Follow must be accepted by Bob's inbox,
+	// and Bob's signed Accept by Alice's.
+	var followee struct {
+		ActorID string `json:"actor_id"`
+	}
+	status = alice.do("POST", "/api/users/follow", aliceToken, map[string]string{"account": bobAccount}, &followee)
+	if status != http.StatusAccepted || followee.ActorID != bobActor {
+		t.Fatalf("follow: status %d, actor %q", status, followee.ActorID)
+	}
+	bob.eventually("Bob's followers to include Alice", func() bool {
+		return strings.Contains(fmt.Sprint(bob.collection(fmt.Sprintf("/ap/users/%d/followers", bobID), "")), aliceActor)
+	})
+	alice.eventually("Alice's follow to be accepted", func() bool {
+		return strings.Contains(fmt.Sprint(alice.collection(fmt.Sprintf("/ap/users/%d/following", aliceID), "")), bobActor)
+	})
+
+	// Bob's new chirp is delivered to his follower as a signed Create.
+	if status := bob.do("POST", "/api/chirps", bobToken, map[string]string{"body": "hello from bob"}, nil); status != http.StatusCreated {
+		t.Fatalf("create chirp: status %d", status)
+	}
+	alice.eventually("the chirp to reach Alice's inbox", func() bool {
+		items := alice.collection(fmt.Sprintf("/ap/users/%d/inbox", aliceID), aliceToken)
+		return len(items) == 1 && strings.Contains(string(items[0]), "hello from bob") &&
+			strings.Contains(string(items[0]), bobActor)
+	})
+
+	// Inboxes only take activities signed by their actor.
+	forged := map[string]interface{}{
+		"@context": activityStreamsContext,
+		"id":       bobActor + "#forged",
+		"type":     "Follow",
+		"actor":    bobActor,
+		"object":   aliceActor,
+	}
+	if status := alice.do("POST", fmt.Sprintf("/ap/users/%d/inbox", aliceID), "", forged, nil); status != http.StatusUnauthorized {
+		t.Errorf("unsigned activity: status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
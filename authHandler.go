@@ -1,17 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Delvoid/chirpy/database"
 	"github.com/dgrijalva/jwt-go"
-	"golang.org/x/crypto/bcrypt"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type loginRequest struct {
@@ -20,102 +23,256 @@ type loginRequest struct {
 	ExpiresInSeconds int    `json:"expires_in_seconds,omitempty"`
 }
 
-func validateToken(r *http.Request, jwtSecret string) (int, error) {
+// accessClaims are the claims of an access token.
+type accessClaims struct {
+	jwt.StandardClaims
+	// Version must match the user's token version, which is incremented to
+	// log them out everywhere.
+	Version int `json:"ver,omitempty"`
+	// SessionID is the session the token was issued to.
+	SessionID string `json:"sid,omitempty"`
+}
+
+func validateToken(r *http.Request, jwtKeys *keyring) (userID int, err error) {
+	userID, _, err = validateAccessToken(r, jwtKeys)
+	return userID, err
+}
+
+// validatedTokenKey is the context key under which withValidatedToken
+// stores a validatedToken.
+type validatedTokenKey struct{}
+
+type validatedToken struct {
+	userID int
+	claims *accessClaims
+	err    error
+}
+
+// withValidatedToken validates the request's access token and attaches the
+// outcome to the returned request, so middleware that needs the user can
+// share the work with the handler.
+func withValidatedToken(r *http.Request, jwtKeys *keyring) *http.Request {
+	userID, claims, err := validateAccessToken(r, jwtKeys)
+	v := validatedToken{userID: userID, claims: claims, err: err}
+	return r.WithContext(context.WithValue(r.Context(), validatedTokenKey{}, v))
+}
+
+// validateAccessToken checks the request's access token and returns its
+// user and claims. Tokens older than the user's last "log out everywhere"
+// are rejected.
+func validateAccessToken(r *http.Request, jwtKeys *keyring) (userID int, claims *accessClaims, err error) {
+	if v, ok := r.Context().Value(validatedTokenKey{}).(validatedToken); ok {
+		return v.userID, v.claims, v.err
+	}
+
+	_, span := tracer.Start(r.Context(), "validateToken")
+	defer func() {
+		if err != nil {
+			spanError(span, err)
+		}
+		span.End()
+	}()
+
 	tokenString := r.Header.Get("Authorization")
 	if tokenString == "" {
-		return 0, errors.New("Missing Authorization header")
+		return 0, nil, errors.New("Missing Authorization header")
 	}
 
 	tokenString = strings.TrimPrefix(tokenString, "Bearer ")
-	claims := &jwt.StandardClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(jwtSecret), nil
-	})
+	claims = &accessClaims{}
+	token, err := jwtKeys.parse(tokenString, claims)
 
 	if err != nil {
-		return 0, errors.New("Invalid token")
+		return 0, nil, errors.New("Invalid token")
 	}
 
 	if !token.Valid {
-		return 0, errors.New("Invalid token")
+		return 0, nil, errors.New("Invalid token")
 	}
 
-	userID, err := strconv.Atoi(claims.Subject)
+	userID, err = strconv.Atoi(claims.Subject)
 	if err != nil {
-		return 0, errors.New("Invalid user ID")
+		return 0, nil, errors.New("Invalid user ID")
+	}
+
+	user, err := database.GetUserByID(r.Context(), userID)
+	if err != nil {
+		return 0, nil, errors.New("Invalid token")
+	}
+	if user.TokenVersion != claims.Version {
+		return 0, nil, errors.New("Token has been revoked")
+	}
+
+	span.SetAttributes(attribute.Int("user.id", userID))
+	setRequestUser(r, userID)
+	return userID, claims, nil
+}
+
+// signAccessToken issues an access token for user in the given session.
+func signAccessToken(jwtKeys *keyring, user database.User, sessionID string, ttl time.Duration) (string, error) {
+	now := jwt.TimeFunc()
+	claims := &accessClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    "chirpy",
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+			Subject:   fmt.Sprintf("%d", user.ID),
+		},
+		Version:   user.TokenVersion,
+		SessionID: sessionID,
 	}
 
-	return userID, nil
+	return jwtKeys.sign(claims)
 }
 
-func loginHandler(jwtSecret string) http.HandlerFunc {
+// maxUserAgentLength bounds the user agent stored with a session.
+const maxUserAgentLength = 256
+
+// sessionClient describes the device making r, to be shown in its session.
+func sessionClient(r *http.Request) database.SessionClient {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+	}
+	return database.SessionClient{UserAgent: userAgent, IP: clientIP(r)}
+}
+
+// passwordHashers builds the hasher selected by password_hasher.
+var passwordHashers = map[string]func(conf config) database.Hasher{
+	"bcrypt": func(conf config) database.Hasher {
+		return database.BcryptHasher{Cost: conf.BcryptCost}
+	},
+	"argon2id": func(conf config) database.Hasher {
+		return database.Argon2idHasher{
+			Memory:      uint32(conf.Argon2Memory),
+			Iterations:  uint32(conf.Argon2Iterations),
+			Parallelism: uint8(conf.Argon2Parallelism),
+		}
+	},
+}
+
+func passwordHasherNames() []string {
+	names := make([]string, 0, len(passwordHashers))
+	for name := range passwordHashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func loginHandler(jwtKeys *keyring, accessTokenTTL, refreshTokenTTL time.Duration, guard *loginGuard, tf *twoFactor) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		var req loginRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			loginFailures.WithLabelValues("bad_request").Inc()
 			respondWithError(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		user, err := database.GetUserByEmail(req.Email)
-		if err != nil {
-			respondWithError(w, "Invalid credentials", http.StatusUnauthorized)
+		ip := clientIP(r)
+		if wait := guard.locked(req.Email, ip, time.Now()); wait > 0 {
+			loginFailures.WithLabelValues("locked").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+			respondWithError(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
 			return
 		}
 
-		err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
+		// Unknown emails are checked against a dummy hash so they take as
+		// long as wrong passwords.
+		user, userErr := database.GetUserByEmail(r.Context(), req.Email)
+		hash := guard.dummyHash
+		if userErr == nil {
+			hash = user.Password
+		}
+		ok, err := database.VerifyPassword(r.Context(), hash, req.Password)
 		if err != nil {
+			slog.ErrorContext(r.Context(), "verifying password failed", "error", err)
+		}
+
+		if userErr != nil || !ok {
+			reason := "wrong_password"
+			if userErr != nil {
+				reason = "unknown_email"
+			}
+			loginFailures.WithLabelValues(reason).Inc()
+			sleep(r.Context(), guard.fail(req.Email, ip, time.Now()))
 			respondWithError(w, "Invalid credentials", http.StatusUnauthorized)
 			return
 		}
 
-		expiresInSeconds := int64(24 * 60 * 60) // Default to 24 hours
-		if req.ExpiresInSeconds > 0 {
-			if req.ExpiresInSeconds > 24*60*60 {
-				expiresInSeconds = int64(24 * 60 * 60) // Limit to 24 hours
+		// Now that we have the plain password, move hashes made by an older
+		// algorithm or cost to the current one.
+		if database.NeedsRehash(user.Password) {
+			err := database.RehashPassword(r.Context(), user.ID, user.Password, req.Password)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "rehashing password failed", "error", err)
 			} else {
-				expiresInSeconds = int64(req.ExpiresInSeconds)
+				passwordRehashes.Inc()
 			}
 		}
 
-		claims := &jwt.StandardClaims{
-			Issuer:    "chirpy",
-			IssuedAt:  jwt.TimeFunc().Unix(),
-			ExpiresAt: jwt.TimeFunc().Unix() + expiresInSeconds,
-			Subject:   fmt.Sprintf("%d", user.ID),
+		expiresInSeconds := int64(accessTokenTTL.Seconds()) // Default to the configured TTL
+		if req.ExpiresInSeconds > 0 && int64(req.ExpiresInSeconds) < expiresInSeconds {
+			expiresInSeconds = int64(req.ExpiresInSeconds) // Never longer than the configured TTL
 		}
 
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenString, err := token.SignedString([]byte(jwtSecret))
-		if err != nil {
-			respondWithError(w, "Failed to generate token", http.StatusInternalServerError)
-			return
-		}
+		// Failures are only cleared once the whole login succeeds, second
+		// factor included, so knowing the password doesn't reset a lockout.
+		if user.TOTPEnabled {
+			challenge, err := tf.newChallenge(user.ID, expiresInSeconds)
+			if err != nil {
+				respondWithError(w, "Failed to start two-factor login", http.StatusInternalServerError)
+				return
+			}
 
-		refreshToken, err := database.CreateRefreshToken(user.ID, 60*24*60*60*time.Second) // Expire in 60 days
-		if err != nil {
-			respondWithError(w, "Failed to generate refresh token", http.StatusInternalServerError)
+			respondWithJSON(w, struct {
+				TwoFactorRequired bool   `json:"two_factor_required"`
+				ChallengeToken    string `json:"challenge_token"`
+			}{
+				TwoFactorRequired: true,
+				ChallengeToken:    challenge,
+			}, http.StatusOK)
 			return
 		}
 
-		respondWithJSON(w, struct {
-			ID           int    `json:"id"`
-			Email        string `json:"email"`
-			Token        string `json:"token"`
-			RefreshToken string `json:"refresh_token"`
-			IsChirpyRed  bool   `json:"is_chirpy_red"`
-		}{
-			ID:           user.ID,
-			Email:        user.Email,
-			Token:        tokenString,
-			RefreshToken: refreshToken,
-			IsChirpyRed:  user.IsChirpyRed,
-		}, http.StatusOK)
+		guard.succeed(req.Email)
+		issueTokens(w, r, jwtKeys, user, expiresInSeconds, refreshTokenTTL)
 	}
 
 }
 
-func refreshHandler(jwtSecret string) http.HandlerFunc {
+// issueTokens responds with a new access token and refresh token for user,
+// starting a new session.
+func issueTokens(w http.ResponseWriter, r *http.Request, jwtKeys *keyring, user database.User, expiresInSeconds int64, refreshTokenTTL time.Duration) {
+	refreshToken, session, err := database.CreateRefreshToken(r.Context(), user.ID, refreshTokenTTL, sessionClient(r))
+	if err != nil {
+		respondWithError(w, "Failed to generate refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	tokenString, err := signAccessToken(jwtKeys, user, session.FamilyID, time.Duration(expiresInSeconds)*time.Second)
+	if err != nil {
+		respondWithError(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, struct {
+		ID           int    `json:"id"`
+		Email        string `json:"email"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		IsChirpyRed  bool   `json:"is_chirpy_red"`
+	}{
+		ID:           user.ID,
+		Email:        user.Email,
+		Token:        tokenString,
+		RefreshToken: refreshToken,
+		IsChirpyRed:  user.IsChirpyRed,
+	}, http.StatusOK)
+}
+
+func refreshHandler(jwtKeys *keyring, accessTokenTTL time.Duration) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		tokenString := r.Header.Get("Authorization")
 		if tokenString == "" {
@@ -124,35 +281,34 @@ func refreshHandler(jwtSecret string) http.HandlerFunc {
 		}
 
 		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
-		refreshToken, err := database.GetRefreshToken(tokenString)
+		refreshToken, session, err := database.RotateRefreshToken(r.Context(), tokenString, sessionClient(r))
 		if err != nil {
+			if errors.Is(err, database.ErrRefreshTokenReused) {
+				refreshTokenReuse.Inc()
+				slog.WarnContext(r.Context(), "refresh token reused, revoking its session", "user_id", session.UserID)
+			}
 			respondWithError(w, "Invalid refresh token", http.StatusUnauthorized)
 			return
 		}
 
-		if refreshToken.ExpiresAt.Before(time.Now()) {
-			respondWithError(w, "Refresh token has expired", http.StatusUnauthorized)
+		user, err := database.GetUserByID(r.Context(), session.UserID)
+		if err != nil {
+			respondWithError(w, "Invalid refresh token", http.StatusUnauthorized)
 			return
 		}
 
-		claims := &jwt.StandardClaims{
-			Issuer:    "chirpy",
-			IssuedAt:  jwt.TimeFunc().Unix(),
-			ExpiresAt: jwt.TimeFunc().Unix() + 3600, // Expire in 1 hour
-			Subject:   fmt.Sprintf("%d", refreshToken.UserID),
-		}
-
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenString, err = token.SignedString([]byte(jwtSecret))
+		tokenString, err = signAccessToken(jwtKeys, user, session.FamilyID, accessTokenTTL)
 		if err != nil {
 			respondWithError(w, "Failed to generate token", http.StatusInternalServerError)
 			return
 		}
 
 		respondWithJSON(w, struct {
-			Token string `json:"token"`
+			Token        string `json:"token"`
+			RefreshToken string `json:"refresh_token"`
 		}{
-			Token: tokenString,
+			Token:        tokenString,
+			RefreshToken: refreshToken,
 		}, http.StatusOK)
 	}
 }
@@ -165,7 +321,7 @@ func revokeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tokenString = strings.TrimPrefix(tokenString, "Bearer ")
-	err := database.DeleteRefreshToken(tokenString)
+	err := database.DeleteRefreshToken(r.Context(), tokenString)
 	if err != nil {
 		respondWithError(w, "Invalid refresh token", http.StatusUnauthorized)
 		return
@@ -24,9 +24,9 @@ type Chirp struct {
 	Body string `json:"body"`
 }
 
-func createChirpHandler(jwtSecret string) http.HandlerFunc {
+func createChirpHandler(jwtKeys *keyring) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID, err := validateToken(r, jwtSecret)
+		userID, err := validateToken(r, jwtKeys)
 		if err != nil {
 			respondWithError(w, err.Error(), http.StatusUnauthorized)
 			return
@@ -39,12 +39,14 @@ func createChirpHandler(jwtSecret string) http.HandlerFunc {
 			return
 		}
 
-		chirp, err := database.CreateChirp(resBody.Body, userID)
+		chirp, err := database.CreateChirp(r.Context(), resBody.Body, userID)
 		if err != nil {
 			respondWithError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
+		federateChirp(r.Context(), baseURL(), chirp)
+
 		respondWithJSON(w, chirp, http.StatusCreated)
 
 	}
@@ -58,7 +60,7 @@ func getChirpsHandler(w http.ResponseWriter, r *http.Request) {
 	var err error
 
 	if authorIdStr == "" {
-		chirps, err = database.GetChirps()
+		chirps, err = database.GetChirps(r.Context())
 	} else {
 
 		authorId, err := strconv.Atoi(authorIdStr)
@@ -66,7 +68,7 @@ func getChirpsHandler(w http.ResponseWriter, r *http.Request) {
 			respondWithError(w, "Invalid author ID", http.StatusBadRequest)
 			return
 		}
-		chirps, err = database.GetChirpsByAuthorID(authorId)
+		chirps, err = database.GetChirpsByAuthorID(r.Context(), authorId)
 		if err != nil {
 			respondWithError(w, "Failed to retrieve chirps", http.StatusInternalServerError)
 			return
@@ -92,7 +94,7 @@ func getChirpByIDHandler(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, "Invalid chirp ID", http.StatusBadRequest)
 		return
 	}
-	chirp, err := database.GetChirpByID(chirpID)
+	chirp, err := database.GetChirpByID(r.Context(), chirpID)
 	if err != nil {
 		if errors.Is(err, database.ErrChirpNotFound) {
 			respondWithError(w, "Chirp not found", http.StatusNotFound)
@@ -105,9 +107,9 @@ func getChirpByIDHandler(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, chirp, http.StatusOK)
 }
 
-func deleteChirpHandler(jwtSecret string) http.HandlerFunc {
+func deleteChirpHandler(jwtKeys *keyring) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID, err := validateToken(r, jwtSecret)
+		userID, err := validateToken(r, jwtKeys)
 		if err != nil {
 			respondWithError(w, err.Error(), http.StatusUnauthorized)
 			return
@@ -119,23 +121,29 @@ func deleteChirpHandler(jwtSecret string) http.HandlerFunc {
 			return
 		}
 
-		chirp, err := database.GetChirpByID(chirpID)
+		chirp, err := database.GetChirpByID(r.Context(), chirpID)
 		if err != nil {
 			respondWithError(w, "Chirp not found", http.StatusNotFound)
 			return
 		}
 
 		if chirp.AuthorID != userID {
-			respondWithError(w, "Not authorized to delete this chirp", http.StatusForbidden)
-			return
+			// Moderators may remove anyone's chirps.
+			user, err := database.GetUserByID(r.Context(), userID)
+			if err != nil || !user.Role.Includes(database.RoleModerator) {
+				respondWithError(w, "Not authorized to delete this chirp", http.StatusForbidden)
+				return
+			}
 		}
 
-		err = database.DeleteChirp(chirpID)
+		err = database.DeleteChirp(r.Context(), chirpID)
 		if err != nil {
 			respondWithError(w, "Failed to delete chirp", http.StatusInternalServerError)
 			return
 		}
 
+		federateDelete(r.Context(), baseURL(), chirp)
+
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
@@ -147,7 +155,11 @@ func respondWithError(w http.ResponseWriter, errorMessage string, statusCode int
 }
 
 func respondWithJSON(w http.ResponseWriter, payload interface{}, statusCode int) {
-	w.Header().Set("Content-Type", "application/json")
+	respondWithContentType(w, payload, "application/json", statusCode)
+}
+
+func respondWithContentType(w http.ResponseWriter, payload interface{}, contentType string, statusCode int) {
+	w.Header().Set("Content-Type", contentType)
 	dat, err := json.Marshal(payload)
 	if err != nil {
 		log.Printf("Error marshalling JSON: %s", err)
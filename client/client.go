@@ -0,0 +1,446 @@
+// Package client is a Go client for the Chirpy API.
+//
+// A Client keeps the access and refresh tokens returned by Login and sends
+// the access token with authenticated requests. When the server rejects an
+// access token with 401 the client exchanges the refresh token via
+// /api/refresh and retries the request once.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+
+	mu           sync.Mutex
+	accessToken  string
+	refreshToken string
+
+	// refreshMu serializes refreshes. Refresh tokens are single use, so two
+	// concurrent refreshes would look like token theft to the server and
+	// end the session.
+	refreshMu sync.Mutex
+
+	// OnTokens, if set, is called whenever the client obtains new tokens, so
+	// callers can persist them.
+	OnTokens func(accessToken, refreshToken string)
+}
+
+// Error is returned for any non-2xx response. Message holds the "error"
+// field of the server's ErrorResponse body.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("chirpy: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("chirpy: %d %s", e.StatusCode, e.Message)
+}
+
+type User struct {
+	ID           int    `json:"id"`
+	Email        string `json:"email"`
+	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	Verified     bool   `json:"verified"`
+	PendingEmail string `json:"pending_email,omitempty"`
+}
+
+// LoginResult is the outcome of Login. When TwoFactorRequired is set no
+// tokens were issued; pass ChallengeToken to LoginTwoFactor with a code.
+type LoginResult struct {
+	User
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+}
+
+type Chirp struct {
+	ID        int       `json:"id"`
+	Body      string    `json:"body"`
+	AuthorID  int       `json:"author_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListChirpsOptions filters and orders ListChirps. Zero values mean no
+// filter and the server's default ascending order.
+type ListChirpsOptions struct {
+	AuthorID int
+	Sort     string
+}
+
+type authMode int
+
+const (
+	authNone authMode = iota
+	authAccess
+	authRefresh
+)
+
+// New returns a client for the server at baseURL, e.g.
+// "http://localhost:8080".
+func New(baseURL string) *Client {
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// WithHTTPClient replaces the underlying http.Client.
+func (c *Client) WithHTTPClient(httpClient *http.Client) *Client {
+	c.httpClient = httpClient
+	return c
+}
+
+// SetTokens restores previously saved tokens.
+func (c *Client) SetTokens(accessToken, refreshToken string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.accessToken = accessToken
+	c.refreshToken = refreshToken
+}
+
+// Tokens returns the current access and refresh tokens.
+func (c *Client) Tokens() (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.accessToken, c.refreshToken
+}
+
+func (c *Client) CreateUser(ctx context.Context, email, password string) (User, error) {
+	var user User
+	err := c.do(ctx, http.MethodPost, "/api/users", map[string]string{
+		"email":    email,
+		"password": password,
+	}, &user, authNone)
+	return user, err
+}
+
+// Login authenticates and stores the returned tokens on the client.
+func (c *Client) Login(ctx context.Context, email, password string) (LoginResult, error) {
+	var result LoginResult
+	err := c.do(ctx, http.MethodPost, "/api/login", map[string]string{
+		"email":    email,
+		"password": password,
+	}, &result, authNone)
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	if !result.TwoFactorRequired {
+		c.storeTokens(result.Token, result.RefreshToken)
+	}
+	return result, nil
+}
+
+// LoginTwoFactor completes a login that returned TwoFactorRequired, using
+// either a code from the user's authenticator app or one of their recovery
+// codes.
+func (c *Client) LoginTwoFactor(ctx context.Context, challengeToken, code, recoveryCode string) (LoginResult, error) {
+	var result LoginResult
+	err := c.do(ctx, http.MethodPost, "/api/login/2fa", map[string]string{
+		"challenge_token": challengeToken,
+		"code":            code,
+		"recovery_code":   recoveryCode,
+	}, &result, authNone)
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	c.storeTokens(result.Token, result.RefreshToken)
+	return result, nil
+}
+
+// Refresh exchanges the refresh token for a new access token and a
+// replacement refresh token.
+func (c *Client) Refresh(ctx context.Context) (string, error) {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	return c.refresh(ctx)
+}
+
+// refreshUnlessReplaced refreshes the access token after stale was rejected,
+// unless a concurrent request has already replaced it.
+func (c *Client) refreshUnlessReplaced(ctx context.Context, stale string) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	if accessToken, _ := c.Tokens(); accessToken != stale {
+		return nil
+	}
+	_, err := c.refresh(ctx)
+	return err
+}
+
+func (c *Client) refresh(ctx context.Context) (string, error) {
+	var result struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := c.do(ctx, http.MethodPost, "/api/refresh", nil, &result, authRefresh)
+	if err != nil {
+		return "", err
+	}
+
+	_, refreshToken := c.Tokens()
+	if result.RefreshToken != "" {
+		refreshToken = result.RefreshToken
+	}
+	c.storeTokens(result.Token, refreshToken)
+	return result.Token, nil
+}
+
+// Revoke revokes the refresh token and forgets both tokens.
+func (c *Client) Revoke(ctx context.Context) error {
+	err := c.do(ctx, http.MethodPost, "/api/revoke", nil, nil, authRefresh)
+	if err != nil {
+		return err
+	}
+
+	c.storeTokens("", "")
+	return nil
+}
+
+// Session is a login of the authenticated user on some device.
+type Session struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	Current    bool      `json:"current"`
+}
+
+// ListSessions lists the authenticated user's sessions, most recently used
+// first.
+func (c *Client) ListSessions(ctx context.Context) ([]Session, error) {
+	var sessions []Session
+	err := c.do(ctx, http.MethodGet, "/api/sessions", nil, &sessions, authAccess)
+	return sessions, err
+}
+
+// RevokeSession ends one of the authenticated user's sessions.
+func (c *Client) RevokeSession(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/sessions/"+url.PathEscape(id), nil, nil, authAccess)
+}
+
+// LogOutEverywhere ends all of the authenticated user's sessions, this one
+// included, and forgets both tokens.
+func (c *Client) LogOutEverywhere(ctx context.Context) error {
+	err := c.do(ctx, http.MethodDelete, "/api/sessions", nil, nil, authAccess)
+	if err != nil {
+		return err
+	}
+
+	c.storeTokens("", "")
+	return nil
+}
+
+func (c *Client) CreateChirp(ctx context.Context, body string) (Chirp, error) {
+	var chirp Chirp
+	err := c.do(ctx, http.MethodPost, "/api/chirps", map[string]string{"body": body}, &chirp, authAccess)
+	return chirp, err
+}
+
+func (c *Client) ListChirps(ctx context.Context, opts ListChirpsOptions) ([]Chirp, error) {
+	query := url.Values{}
+	if opts.AuthorID != 0 {
+		query.Set("author_id", strconv.Itoa(opts.AuthorID))
+	}
+	if opts.Sort != "" {
+		query.Set("sort", opts.Sort)
+	}
+
+	path := "/api/chirps"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var chirps []Chirp
+	err := c.do(ctx, http.MethodGet, path, nil, &chirps, authNone)
+	return chirps, err
+}
+
+func (c *Client) GetChirp(ctx context.Context, id int) (Chirp, error) {
+	var chirp Chirp
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/chirps/%d", id), nil, &chirp, authNone)
+	return chirp, err
+}
+
+func (c *Client) DeleteChirp(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/api/chirps/%d", id), nil, nil, authAccess)
+}
+
+// UpdateUser changes the authenticated user's email and/or password. Empty
+// values are left unchanged.
+func (c *Client) UpdateUser(ctx context.Context, email, password string) (User, error) {
+	var user User
+	err := c.do(ctx, http.MethodPut, "/api/users", map[string]string{
+		"email":    email,
+		"password": password,
+	}, &user, authAccess)
+	return user, err
+}
+
+// VerifyEmail confirms an email address with a token from a verification
+// email.
+func (c *Client) VerifyEmail(ctx context.Context, token string) (User, error) {
+	var user User
+	err := c.do(ctx, http.MethodPost, "/api/users/verify", map[string]string{"token": token}, &user, authNone)
+	return user, err
+}
+
+// ResendVerification mails a new verification token for the authenticated
+// user's pending or unverified email.
+func (c *Client) ResendVerification(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/api/users/verify/resend", nil, nil, authAccess)
+}
+
+// ForgotPassword asks the server to mail a password reset token to email.
+// It succeeds whether or not the email belongs to an account.
+func (c *Client) ForgotPassword(ctx context.Context, email string) error {
+	return c.do(ctx, http.MethodPost, "/api/password/forgot", map[string]string{"email": email}, nil, authNone)
+}
+
+// ResetPassword sets a new password using a token from a reset email. The
+// user's existing sessions are signed out.
+func (c *Client) ResetPassword(ctx context.Context, token, password string) error {
+	return c.do(ctx, http.MethodPost, "/api/password/reset", map[string]string{
+		"token":    token,
+		"password": password,
+	}, nil, authNone)
+}
+
+// TwoFactorSetup is returned by SetupTwoFactor. Show URI as a QR code or
+// Secret for manual entry, then confirm with EnableTwoFactor.
+type TwoFactorSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// SetupTwoFactor starts enrolling an authenticator app for the
+// authenticated user.
+func (c *Client) SetupTwoFactor(ctx context.Context) (TwoFactorSetup, error) {
+	var setup TwoFactorSetup
+	err := c.do(ctx, http.MethodPost, "/api/users/2fa/setup", nil, &setup, authAccess)
+	return setup, err
+}
+
+// EnableTwoFactor confirms enrollment with a code from the authenticator app
+// and returns the user's recovery codes, which are not shown again.
+func (c *Client) EnableTwoFactor(ctx context.Context, code string) ([]string, error) {
+	var result struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	err := c.do(ctx, http.MethodPost, "/api/users/2fa/verify", map[string]string{
+		"code": code,
+	}, &result, authAccess)
+	return result.RecoveryCodes, err
+}
+
+func (c *Client) storeTokens(accessToken, refreshToken string) {
+	c.SetTokens(accessToken, refreshToken)
+	if c.OnTokens != nil {
+		c.OnTokens(accessToken, refreshToken)
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}, auth authMode) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	accessToken, _ := c.Tokens()
+	resp, err := c.send(ctx, method, path, body, auth)
+	if err != nil {
+		return err
+	}
+
+	_, refreshToken := c.Tokens()
+	if resp.StatusCode == http.StatusUnauthorized && auth == authAccess && refreshToken != "" {
+		resp.Body.Close()
+
+		if err := c.refreshUnlessReplaced(ctx, accessToken); err != nil {
+			return err
+		}
+
+		resp, err = c.send(ctx, method, path, body, auth)
+		if err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decodeError(resp)
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body []byte, auth authMode) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	accessToken, refreshToken := c.Tokens()
+	switch auth {
+	case authAccess:
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	case authRefresh:
+		req.Header.Set("Authorization", "Bearer "+refreshToken)
+	}
+
+	return c.httpClient.Do(req)
+}
+
+func decodeError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if json.Unmarshal(data, &body) == nil {
+		apiErr.Message = body.Error
+	}
+
+	return apiErr
+}
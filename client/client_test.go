@@ -0,0 +1,197 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeServer issues numbered tokens and, like Chirpy, accepts only the
+// latest access token and treats refresh tokens as single use.
+type fakeServer struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	generation int
+	refreshes  int
+	// refreshFails makes /api/refresh reject every token.
+	refreshFails bool
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	s := &fakeServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/login", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.generation++
+		writeJSON(w, http.StatusOK, s.tokens())
+	})
+	mux.HandleFunc("POST /api/refresh", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.refreshes++
+		if s.refreshFails || bearer(r) != fmt.Sprintf("refresh-%d", s.generation) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Invalid refresh token"})
+			return
+		}
+		s.generation++
+		writeJSON(w, http.StatusOK, s.tokens())
+	})
+	mux.HandleFunc("POST /api/chirps", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		valid := bearer(r) == fmt.Sprintf("access-%d", s.generation)
+		s.mu.Unlock()
+		if !valid {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Invalid token"})
+			return
+		}
+		var req struct {
+			Body string `json:"body"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		writeJSON(w, http.StatusCreated, Chirp{ID: 1, Body: req.Body})
+	})
+	mux.HandleFunc("GET /api/chirps/{id}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Chirp not found"})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeServer) tokens() map[string]string {
+	return map[string]string{
+		"token":         fmt.Sprintf("access-%d", s.generation),
+		"refresh_token": fmt.Sprintf("refresh-%d", s.generation),
+	}
+}
+
+func (s *fakeServer) refreshCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refreshes
+}
+
+func bearer(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestAutoRefresh(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup runs after login and before CreateChirp.
+		setup     func(s *fakeServer, c *Client)
+		status    int // 0 for success
+		refreshes int
+		access    string
+	}{
+		{"valid token", func(s *fakeServer, c *Client) {}, 0, 0, "access-1"},
+		{"expired token", func(s *fakeServer, c *Client) {
+			c.SetTokens("stale", "refresh-1")
+		}, 0, 1, "access-2"},
+		{"refresh rejected", func(s *fakeServer, c *Client) {
+			c.SetTokens("stale", "refresh-1")
+			s.refreshFails = true
+		}, http.StatusUnauthorized, 1, "stale"},
+		{"no refresh token", func(s *fakeServer, c *Client) {
+			c.SetTokens("stale", "")
+		}, http.StatusUnauthorized, 0, "stale"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeServer(t)
+			c := New(s.URL)
+			if _, err := c.Login(context.Background(), "walt@example.com", "blue sky meth lab"); err != nil {
+				t.Fatal(err)
+			}
+			tt.setup(s, c)
+
+			var saved []string
+			c.OnTokens = func(accessToken, refreshToken string) {
+				saved = append(saved, accessToken+" "+refreshToken)
+			}
+
+			chirp, err := c.CreateChirp(context.Background(), "I am the one who knocks")
+			if tt.status == 0 {
+				if err != nil || chirp.Body != "I am the one who knocks" {
+					t.Fatalf("CreateChirp = %+v, %v", chirp, err)
+				}
+			} else {
+				var apiErr *Error
+				if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.status {
+					t.Fatalf("CreateChirp error = %v, want status %d", err, tt.status)
+				}
+			}
+
+			if n := s.refreshCount(); n != tt.refreshes {
+				t.Errorf("refreshed %d times, want %d", n, tt.refreshes)
+			}
+			if access, _ := c.Tokens(); access != tt.access {
+				t.Errorf("access token = %q, want %q", access, tt.access)
+			}
+			if tt.refreshes > 0 && tt.status == 0 && (len(saved) != 1 || saved[0] != "access-2 refresh-2") {
+				t.Errorf("OnTokens calls = %q, want the refreshed tokens", saved)
+			}
+		})
+	}
+}
+
+func TestConcurrentRequestsRefreshOnce(t *testing.T) {
+	s := newFakeServer(t)
+	c := New(s.URL)
+	c.SetTokens("stale", "refresh-0")
+
+	// Every request fails with the stale token; only the first to take
+	// the refresh lock should spend the single-use refresh token.
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.CreateChirp(context.Background(), "say my name")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("CreateChirp: %v", err)
+		}
+	}
+	if n := s.refreshCount(); n != 1 {
+		t.Errorf("refreshed %d times, want 1", n)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	s := newFakeServer(t)
+	c := New(s.URL)
+
+	_, err := c.GetChirp(context.Background(), 42)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("GetChirp error = %v, want *Error", err)
+	}
+	if apiErr.StatusCode != http.StatusNotFound || apiErr.Message != "Chirp not found" {
+		t.Errorf("error = %+v", apiErr)
+	}
+	if s.refreshCount() != 0 {
+		t.Error("unauthenticated request tried to refresh")
+	}
+}
@@ -0,0 +1,458 @@
+// Command chirpy is a command-line client for the Chirpy API.
+//
+// Usage:
+//
+//	chirpy [-server URL] [-config FILE] <command> [arguments]
+//
+// The commands are:
+//
+//	login     authenticate and save the session
+//	logout    revoke the saved session
+//	post      create a chirp
+//	timeline  list chirps
+//	delete    delete one of your chirps
+//	whoami    show the logged in user
+//	sessions  list or revoke your sessions
+//	2fa       enable two-factor authentication
+//
+// The refresh token is stored in the config file (by default
+// $XDG_CONFIG_HOME/chirpy/config.json) and access tokens are refreshed
+// transparently when they expire.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Delvoid/chirpy/client"
+	"golang.org/x/term"
+)
+
+type config struct {
+	Server       string `json:"server"`
+	UserID       int    `json:"user_id,omitempty"`
+	Email        string `json:"email,omitempty"`
+	AccessToken  string `json:"access_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(ctx context.Context, app *app, args []string) error
+}
+
+type app struct {
+	configPath string
+	config     config
+	client     *client.Client
+}
+
+var commands = []command{
+	{"login", "login [-email EMAIL]", "authenticate and save the session", runLogin},
+	{"logout", "logout", "revoke the saved session", runLogout},
+	{"post", "post TEXT...", "create a chirp", runPost},
+	{"timeline", "timeline [-author ID] [-mine] [-sort asc|desc] [-n LIMIT]", "list chirps", runTimeline},
+	{"delete", "delete CHIRP_ID", "delete one of your chirps", runDelete},
+	{"whoami", "whoami", "show the logged in user", runWhoami},
+	{"sessions", "sessions [-revoke ID] [-all]", "list or revoke your sessions", runSessions},
+	{"2fa", "2fa", "enable two-factor authentication", runTwoFactor},
+}
+
+func main() {
+	flags := flag.NewFlagSet("chirpy", flag.ExitOnError)
+	server := flags.String("server", os.Getenv("CHIRPY_SERVER"), "Chirpy server URL (default http://localhost:8080)")
+	configPath := flags.String("config", os.Getenv("CHIRPY_CONFIG"), "path to the config file")
+	flags.Usage = usage(flags)
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == flags.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "chirpy: unknown command %q\n", flags.Arg(0))
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	a, err := newApp(*configPath, *server)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "chirpy: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := cmd.run(ctx, a, flags.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+		os.Exit(1)
+	}
+}
+
+func usage(flags *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, "Usage: chirpy [flags] <command> [arguments]")
+		fmt.Fprintln(os.Stderr, "\nCommands:")
+		w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+		for _, cmd := range commands {
+			fmt.Fprintf(w, "  %s\t%s\n", cmd.usage, cmd.summary)
+		}
+		w.Flush()
+		fmt.Fprintln(os.Stderr, "\nFlags:")
+		flags.PrintDefaults()
+	}
+}
+
+func newApp(configPath, server string) (*app, error) {
+	if configPath == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, err
+		}
+		configPath = filepath.Join(dir, "chirpy", "config.json")
+	}
+
+	a := &app{configPath: configPath}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &a.config); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", configPath, err)
+		}
+	}
+
+	if server != "" && server != a.config.Server {
+		// Tokens are only valid for the server that issued them.
+		a.config = config{Server: server}
+	}
+	if a.config.Server == "" {
+		a.config.Server = "http://localhost:8080"
+	}
+
+	a.client = client.New(a.config.Server)
+	a.client.SetTokens(a.config.AccessToken, a.config.RefreshToken)
+	a.client.OnTokens = func(accessToken, refreshToken string) {
+		a.config.AccessToken = accessToken
+		a.config.RefreshToken = refreshToken
+		if err := a.save(); err != nil {
+			fmt.Fprintf(os.Stderr, "chirpy: saving session: %v\n", err)
+		}
+	}
+
+	return a, nil
+}
+
+func (a *app) save() error {
+	if err := os.MkdirAll(filepath.Dir(a.configPath), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(a.config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The file holds a long-lived refresh token, so keep it private.
+	return os.WriteFile(a.configPath, data, 0600)
+}
+
+func (a *app) requireLogin() error {
+	if a.config.RefreshToken == "" {
+		return errors.New("not logged in; run 'chirpy login' first")
+	}
+	return nil
+}
+
+func runLogin(ctx context.Context, a *app, args []string) error {
+	flags := flag.NewFlagSet("login", flag.ExitOnError)
+	email := flags.String("email", "", "account email")
+	flags.Parse(args)
+
+	reader := bufio.NewReader(os.Stdin)
+	if *email == "" {
+		line, err := prompt(reader, "Email: ")
+		if err != nil {
+			return err
+		}
+		*email = line
+	}
+
+	password, err := readPassword(reader)
+	if err != nil {
+		return err
+	}
+
+	result, err := a.client.Login(ctx, *email, password)
+	if err != nil {
+		return err
+	}
+
+	if result.TwoFactorRequired {
+		code, err := prompt(reader, "Authentication code (or recovery code): ")
+		if err != nil {
+			return err
+		}
+
+		// Authenticator codes are all digits; anything else is a recovery
+		// code.
+		totp, recovery := code, ""
+		if strings.Trim(code, "0123456789 ") != "" {
+			totp, recovery = "", code
+		}
+		result, err = a.client.LoginTwoFactor(ctx, result.ChallengeToken, totp, recovery)
+		if err != nil {
+			return err
+		}
+	}
+
+	a.config.UserID = result.ID
+	a.config.Email = result.Email
+	if err := a.save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Logged in as %s (user %d)\n", result.Email, result.ID)
+	return nil
+}
+
+func prompt(reader *bufio.Reader, label string) (string, error) {
+	fmt.Fprint(os.Stderr, label)
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// readPassword reads a password without echo from a terminal, falling back
+// to a plain line from stdin so the CLI can be scripted.
+func readPassword(reader *bufio.Reader) (string, error) {
+	if password := os.Getenv("CHIRPY_PASSWORD"); password != "" {
+		return password, nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		password, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func runLogout(ctx context.Context, a *app, args []string) error {
+	if err := a.requireLogin(); err != nil {
+		return err
+	}
+
+	err := a.client.Revoke(ctx)
+	var apiErr *client.Error
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.StatusCode == 401) {
+		return err
+	}
+
+	a.config = config{Server: a.config.Server}
+	if err := a.save(); err != nil {
+		return err
+	}
+
+	fmt.Println("Logged out")
+	return nil
+}
+
+func runPost(ctx context.Context, a *app, args []string) error {
+	if err := a.requireLogin(); err != nil {
+		return err
+	}
+
+	body := strings.Join(args, " ")
+	if body == "" {
+		return errors.New("usage: chirpy post TEXT...")
+	}
+
+	chirp, err := a.client.CreateChirp(ctx, body)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Posted chirp %d\n", chirp.ID)
+	return nil
+}
+
+func runTimeline(ctx context.Context, a *app, args []string) error {
+	flags := flag.NewFlagSet("timeline", flag.ExitOnError)
+	author := flags.Int("author", 0, "only show chirps by this user ID")
+	mine := flags.Bool("mine", false, "only show your own chirps")
+	sortOrder := flags.String("sort", "desc", "sort order: asc or desc")
+	limit := flags.Int("n", 20, "maximum number of chirps to show (0 for all)")
+	flags.Parse(args)
+
+	opts := client.ListChirpsOptions{AuthorID: *author, Sort: *sortOrder}
+	if *mine {
+		if err := a.requireLogin(); err != nil {
+			return err
+		}
+		opts.AuthorID = a.config.UserID
+	}
+
+	chirps, err := a.client.ListChirps(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if *limit > 0 && len(chirps) > *limit {
+		chirps = chirps[:*limit]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tAUTHOR\tPOSTED\tBODY")
+	for _, chirp := range chirps {
+		posted := "-"
+		if !chirp.CreatedAt.IsZero() {
+			posted = chirp.CreatedAt.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", chirp.ID, chirp.AuthorID, posted, chirp.Body)
+	}
+	return w.Flush()
+}
+
+func runDelete(ctx context.Context, a *app, args []string) error {
+	if err := a.requireLogin(); err != nil {
+		return err
+	}
+
+	if len(args) != 1 {
+		return errors.New("usage: chirpy delete CHIRP_ID")
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid chirp ID %q", args[0])
+	}
+
+	if err := a.client.DeleteChirp(ctx, id); err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted chirp %d\n", id)
+	return nil
+}
+
+func runWhoami(ctx context.Context, a *app, args []string) error {
+	if err := a.requireLogin(); err != nil {
+		return err
+	}
+
+	// Refreshing proves the saved session is still valid.
+	if _, err := a.client.Refresh(ctx); err != nil {
+		return fmt.Errorf("session is no longer valid, run 'chirpy login': %w", err)
+	}
+
+	fmt.Printf("%s (user %d) on %s\n", a.config.Email, a.config.UserID, a.config.Server)
+	return nil
+}
+
+func runSessions(ctx context.Context, a *app, args []string) error {
+	flags := flag.NewFlagSet("sessions", flag.ExitOnError)
+	revoke := flags.String("revoke", "", "revoke the session with this ID")
+	all := flags.Bool("all", false, "log out everywhere, including here")
+	flags.Parse(args)
+
+	if err := a.requireLogin(); err != nil {
+		return err
+	}
+
+	switch {
+	case *all:
+		if err := a.client.LogOutEverywhere(ctx); err != nil {
+			return err
+		}
+		a.config = config{Server: a.config.Server}
+		if err := a.save(); err != nil {
+			return err
+		}
+		fmt.Println("Logged out everywhere")
+		return nil
+	case *revoke != "":
+		if err := a.client.RevokeSession(ctx, *revoke); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked session %s\n", *revoke)
+		return nil
+	}
+
+	sessions, err := a.client.ListSessions(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTARTED\tLAST USED\tIP\tCLIENT")
+	for _, session := range sessions {
+		id := session.ID
+		if session.Current {
+			id += " *"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", id,
+			session.CreatedAt.Local().Format("2006-01-02 15:04"),
+			session.LastUsedAt.Local().Format("2006-01-02 15:04"),
+			session.IP, session.UserAgent)
+	}
+	return w.Flush()
+}
+
+func runTwoFactor(ctx context.Context, a *app, args []string) error {
+	if err := a.requireLogin(); err != nil {
+		return err
+	}
+
+	setup, err := a.client.SetupTwoFactor(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Add this account to your authenticator app:\n\n  %s\n\nor enter the key manually: %s\n\n", setup.URI, setup.Secret)
+	code, err := prompt(bufio.NewReader(os.Stdin), "Authentication code: ")
+	if err != nil {
+		return err
+	}
+
+	codes, err := a.client.EnableTwoFactor(ctx, code)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Two-factor authentication enabled. Keep these recovery codes somewhere safe;")
+	fmt.Println("each can be used once instead of a code if you lose your device:")
+	fmt.Println()
+	for _, c := range codes {
+		fmt.Printf("  %s\n", c)
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+// Command chirpyctl operates on a Chirpy database file directly, for
+// maintenance that the API does not offer.
+//
+// Usage:
+//
+//	chirpyctl [-db FILE] <command> [arguments]
+//
+// chirpyctl reads and rewrites the whole file, so stop the server before
+// making changes or they will be overwritten by its next save.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Delvoid/chirpy/database"
+)
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{"list-users", "list-users", "list all users", runListUsers},
+	{"search-users", "search-users QUERY", "find users whose email contains QUERY", runSearchUsers},
+	{"reset-password", "reset-password [-password PASSWORD] USER_ID", "set a new password and revoke the user's sessions", runResetPassword},
+	{"end-sessions", "end-sessions USER_ID", "log a user out everywhere", runEndSessions},
+	{"set-red", "set-red USER_ID true|false", "grant or remove Chirpy Red", runSetRed},
+	{"set-role", "set-role USER_ID user|moderator|admin", "change a user's role", runSetRole},
+	{"purge-tokens", "purge-tokens", "delete expired refresh, password reset and email verification tokens", runPurgeTokens},
+	{"delete-chirp", "delete-chirp CHIRP_ID", "delete a chirp", runDeleteChirp},
+	{"check", "check", "validate the integrity of the database", runCheck},
+}
+
+func main() {
+	flags := flag.NewFlagSet("chirpyctl", flag.ExitOnError)
+	dbPath := flags.String("db", "database.json", "path to the database file")
+	flags.Usage = usage(flags)
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == flags.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "chirpyctl: unknown command %q\n", flags.Arg(0))
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if _, err := os.Stat(*dbPath); err != nil {
+		fmt.Fprintf(os.Stderr, "chirpyctl: %v\n", err)
+		os.Exit(1)
+	}
+
+	database.SetPath(*dbPath)
+	if err := database.Init(); err != nil {
+		fmt.Fprintf(os.Stderr, "chirpyctl: failed to load %s: %v\n", *dbPath, err)
+		os.Exit(1)
+	}
+
+	if err := cmd.run(context.Background(), flags.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+		os.Exit(1)
+	}
+}
+
+func usage(flags *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, "Usage: chirpyctl [flags] <command> [arguments]")
+		fmt.Fprintln(os.Stderr, "\nCommands:")
+		w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+		for _, cmd := range commands {
+			fmt.Fprintf(w, "  %s\t%s\n", cmd.usage, cmd.summary)
+		}
+		w.Flush()
+		fmt.Fprintln(os.Stderr, "\nFlags:")
+		flags.PrintDefaults()
+	}
+}
+
+func runListUsers(ctx context.Context, args []string) error {
+	users, err := database.GetUsers(ctx)
+	if err != nil {
+		return err
+	}
+	return printUsers(users)
+}
+
+func runSearchUsers(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: chirpyctl search-users QUERY")
+	}
+
+	users, err := database.SearchUsers(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return printUsers(users)
+}
+
+func printUsers(users []database.User) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEMAIL\tVERIFIED\tROLE\tCHIRPY RED")
+	for _, user := range users {
+		fmt.Fprintf(w, "%d\t%s\t%t\t%s\t%t\n", user.ID, user.Email, user.Verified, user.Role, user.IsChirpyRed)
+	}
+	return w.Flush()
+}
+
+func runResetPassword(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("reset-password", flag.ExitOnError)
+	password := flags.String("password", "", "new password (default: generate one)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: chirpyctl reset-password [-password PASSWORD] USER_ID")
+	}
+	userID, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid user ID %q", flags.Arg(0))
+	}
+
+	generated := *password == ""
+	if generated {
+		buf := make([]byte, 12)
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		*password = base64.RawURLEncoding.EncodeToString(buf)
+	}
+
+	user, err := database.UpdateUser(ctx, userID, "", *password)
+	if err != nil {
+		return err
+	}
+
+	ended, err := database.EndAllSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Reset password for %s (user %d), ended %d sessions\n", user.Email, user.ID, ended)
+	if generated {
+		fmt.Printf("New password: %s\n", *password)
+	}
+	return nil
+}
+
+func runEndSessions(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: chirpyctl end-sessions USER_ID")
+	}
+	userID, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid user ID %q", args[0])
+	}
+
+	ended, err := database.EndAllSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Ended %d sessions for user %d\n", ended, userID)
+	return nil
+}
+
+func runSetRed(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: chirpyctl set-red USER_ID true|false")
+	}
+	userID, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid user ID %q", args[0])
+	}
+	isChirpyRed, err := strconv.ParseBool(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid value %q, expected true or false", args[1])
+	}
+
+	if err := database.SetChirpyRed(ctx, userID, isChirpyRed); err != nil {
+		return err
+	}
+
+	fmt.Printf("User %d is_chirpy_red=%t\n", userID, isChirpyRed)
+	return nil
+}
+
+func runSetRole(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: chirpyctl set-role USER_ID user|moderator|admin")
+	}
+	userID, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid user ID %q", args[0])
+	}
+	role, err := database.ParseRole(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid role %q, expected user, moderator or admin", args[1])
+	}
+
+	if err := database.SetRole(ctx, userID, role); err != nil {
+		return err
+	}
+
+	fmt.Printf("User %d role=%s\n", userID, role)
+	return nil
+}
+
+func runPurgeTokens(ctx context.Context, args []string) error {
+	removed, err := database.PurgeExpiredRefreshTokens(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	mailTokens, err := database.PurgeExpiredMailTokens(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed %d expired refresh tokens and %d expired password reset and email verification tokens\n", removed, mailTokens)
+	return nil
+}
+
+func runDeleteChirp(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: chirpyctl delete-chirp CHIRP_ID")
+	}
+	chirpID, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid chirp ID %q", args[0])
+	}
+
+	if err := database.DeleteChirp(ctx, chirpID); err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted chirp %d\n", chirpID)
+	return nil
+}
+
+func runCheck(ctx context.Context, args []string) error {
+	issues, err := database.CheckIntegrity(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(issues) == 0 {
+		fmt.Println("No problems found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, issue := range issues {
+		fmt.Fprintf(w, "%s\t%s\n", issue.Kind, issue.Message)
+	}
+	w.Flush()
+
+	return fmt.Errorf("found %d problems", len(issues))
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// config holds every server setting. Values are resolved in increasing order
+// of precedence: defaults, config file, environment (including .env), flags.
+type config struct {
+	ListenAddr              string
+	PublicURL               string
+	FederationAllowPrivate  bool
+	DataPath                string
+	JWTSecret               string
+	JWTPreviousSecrets      string
+	JWTAlgorithm            string
+	JWTPrivateKeyFile       string
+	JWTVerifyKeyFiles       string
+	PolkaAPIKey             string
+	TOTPEncryptionKey       string
+	BootstrapAdminEmail     string
+	AccessTokenTTL          time.Duration
+	RefreshedAccessTokenTTL time.Duration
+	RefreshTokenTTL         time.Duration
+	PasswordHasher          string
+	BcryptCost              int
+	Argon2Memory            int
+	Argon2Iterations        int
+	Argon2Parallelism       int
+	PasswordMinLength       int
+	PasswordRejectCommon    bool
+	LoginLockoutThreshold   int
+	LoginIPLockoutThreshold int
+	LoginLockoutDuration    time.Duration
+	PasswordResetTTL        time.Duration
+	PasswordResetURL        string
+	EmailVerificationTTL    time.Duration
+	EmailVerificationURL    string
+	Mailer                  string
+	MailFrom                string
+	MailFile                string
+	SMTPAddr                string
+	SMTPUsername            string
+	SMTPPassword            string
+	MaxChirpLength          int
+	MaxBodyBytes            int64
+	RateLimit               bool
+	TLSCertFile             string
+	TLSKeyFile              string
+	HTTPRedirectAddr        string
+	HSTSMaxAge              time.Duration
+	ShutdownTimeout         time.Duration
+	RefreshPurgeInterval    time.Duration
+	MailPurgeInterval       time.Duration
+	LogLevel                slog.Level
+	TraceExporter           string
+	TraceFile               string
+	Debug                   bool
+}
+
+// configField describes one setting and the names it goes by in each
+// source. Secrets have no flag so they don't end up in process listings.
+type configField struct {
+	key   string
+	env   string
+	flag  string
+	usage string
+	set   setter
+}
+
+// setter parses a setting's value into the config.
+type setter struct {
+	parse func(c *config, value string) error
+	// boolean settings may be given as a bare flag, like -rate-limit.
+	boolean bool
+}
+
+// settingFlag holds a setting's command line value until it is parsed
+// along with the other sources.
+type settingFlag struct {
+	value   string
+	boolean bool
+}
+
+func (f *settingFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *settingFlag) Set(value string) error {
+	f.value = value
+	return nil
+}
+
+func (f *settingFlag) IsBoolFlag() bool { return f.boolean }
+
+var configFields = []configField{
+	{"listen_addr", "CHIRPY_ADDR", "addr", "address to listen on", setString(func(c *config) *string { return &c.ListenAddr })},
+	{"public_url", "CHIRPY_PUBLIC_URL", "public-url", "scheme and host clients reach the server at, used in feed and federation links; derived from listen_addr if unset", setString(func(c *config) *string { return &c.PublicURL })},
+	{"federation_allow_private", "CHIRPY_FEDERATION_ALLOW_PRIVATE", "federation-allow-private", "let federation requests reach loopback and private network addresses, for local testing only", setBool(func(c *config) *bool { return &c.FederationAllowPrivate })},
+	{"data_path", "CHIRPY_DATA_PATH", "data", "path to the database file", setString(func(c *config) *string { return &c.DataPath })},
+	{"jwt_secret", "JWT_SECRET", "", "secret used to sign access tokens", setString(func(c *config) *string { return &c.JWTSecret })},
+	{"jwt_previous_secrets", "JWT_PREVIOUS_SECRETS", "", "comma-separated retired HS256 secrets whose tokens are still accepted", setString(func(c *config) *string { return &c.JWTPreviousSecrets })},
+	{"jwt_algorithm", "CHIRPY_JWT_ALGORITHM", "jwt-algorithm", "how access tokens are signed: HS256 with jwt_secret, or RS256 or EdDSA with jwt_private_key_file", setString(func(c *config) *string { return &c.JWTAlgorithm })},
+	{"jwt_private_key_file", "CHIRPY_JWT_PRIVATE_KEY_FILE", "jwt-private-key", "PEM RSA or Ed25519 private key that signs access tokens when jwt_algorithm is RS256 or EdDSA", setString(func(c *config) *string { return &c.JWTPrivateKeyFile })},
+	{"jwt_verify_key_files", "CHIRPY_JWT_VERIFY_KEY_FILES", "jwt-verify-keys", "comma-separated PEM files of retired RS256 or EdDSA keys whose tokens are still accepted", setString(func(c *config) *string { return &c.JWTVerifyKeyFiles })},
+	{"polka_api_key", "POLKA_API_KEY", "", "API key expected on Polka webhooks", setString(func(c *config) *string { return &c.PolkaAPIKey })},
+	{"totp_encryption_key", "TOTP_ENCRYPTION_KEY", "", "key used to encrypt two-factor secrets; derived from jwt_secret if unset", setString(func(c *config) *string { return &c.TOTPEncryptionKey })},
+	{"bootstrap_admin_email", "CHIRPY_BOOTSTRAP_ADMIN_EMAIL", "bootstrap-admin-email", "user made admin while no admin exists, at startup or when they verify their email", setString(func(c *config) *string { return &c.BootstrapAdminEmail })},
+	{"access_token_ttl", "CHIRPY_ACCESS_TOKEN_TTL", "access-token-ttl", "default and maximum lifetime of access tokens issued at login", setDuration(func(c *config) *time.Duration { return &c.AccessTokenTTL })},
+	{"refreshed_access_token_ttl", "CHIRPY_REFRESHED_ACCESS_TOKEN_TTL", "refreshed-access-token-ttl", "lifetime of access tokens issued by /api/refresh", setDuration(func(c *config) *time.Duration { return &c.RefreshedAccessTokenTTL })},
+	{"refresh_token_ttl", "CHIRPY_REFRESH_TOKEN_TTL", "refresh-token-ttl", "lifetime of refresh tokens", setDuration(func(c *config) *time.Duration { return &c.RefreshTokenTTL })},
+	{"password_hasher", "CHIRPY_PASSWORD_HASHER", "password-hasher", "algorithm for new password hashes: bcrypt or argon2id; older hashes are upgraded at login", setString(func(c *config) *string { return &c.PasswordHasher })},
+	{"bcrypt_cost", "CHIRPY_BCRYPT_COST", "bcrypt-cost", "bcrypt cost for new password hashes", setInt(func(c *config) *int { return &c.BcryptCost })},
+	{"argon2_memory", "CHIRPY_ARGON2_MEMORY", "argon2-memory", "argon2id memory in KiB", setInt(func(c *config) *int { return &c.Argon2Memory })},
+	{"argon2_iterations", "CHIRPY_ARGON2_ITERATIONS", "argon2-iterations", "argon2id passes over memory", setInt(func(c *config) *int { return &c.Argon2Iterations })},
+	{"argon2_parallelism", "CHIRPY_ARGON2_PARALLELISM", "argon2-parallelism", "argon2id lanes", setInt(func(c *config) *int { return &c.Argon2Parallelism })},
+	{"password_min_length", "CHIRPY_PASSWORD_MIN_LENGTH", "password-min-length", "fewest characters a new password may have", setInt(func(c *config) *int { return &c.PasswordMinLength })},
+	{"password_reject_common", "CHIRPY_PASSWORD_REJECT_COMMON", "password-reject-common", "refuse new passwords on the bundled list of common and breached passwords", setBool(func(c *config) *bool { return &c.PasswordRejectCommon })},
+	{"login_lockout_threshold", "CHIRPY_LOGIN_LOCKOUT_THRESHOLD", "login-lockout-threshold", "failed logins for one email before it is locked out", setInt(func(c *config) *int { return &c.LoginLockoutThreshold })},
+	{"login_ip_lockout_threshold", "CHIRPY_LOGIN_IP_LOCKOUT_THRESHOLD", "login-ip-lockout-threshold", "failed logins from one IP before it is locked out", setInt(func(c *config) *int { return &c.LoginIPLockoutThreshold })},
+	{"login_lockout_duration", "CHIRPY_LOGIN_LOCKOUT_DURATION", "login-lockout-duration", "how long lockouts last and how long failures are remembered", setDuration(func(c *config) *time.Duration { return &c.LoginLockoutDuration })},
+	{"password_reset_ttl", "CHIRPY_PASSWORD_RESET_TTL", "password-reset-ttl", "how long password reset tokens stay valid", setDuration(func(c *config) *time.Duration { return &c.PasswordResetTTL })},
+	{"password_reset_url", "CHIRPY_PASSWORD_RESET_URL", "password-reset-url", "page linked from reset emails, with the token appended as ?token=", setString(func(c *config) *string { return &c.PasswordResetURL })},
+	{"email_verification_ttl", "CHIRPY_EMAIL_VERIFICATION_TTL", "email-verification-ttl", "how long email verification tokens stay valid", setDuration(func(c *config) *time.Duration { return &c.EmailVerificationTTL })},
+	{"email_verification_url", "CHIRPY_EMAIL_VERIFICATION_URL", "email-verification-url", "page linked from verification emails, with the token appended as ?token=", setString(func(c *config) *string { return &c.EmailVerificationURL })},
+	{"mailer", "CHIRPY_MAILER", "mailer", "how to send email: log, file or smtp", setString(func(c *config) *string { return &c.Mailer })},
+	{"mail_from", "CHIRPY_MAIL_FROM", "mail-from", "sender address of outgoing email", setString(func(c *config) *string { return &c.MailFrom })},
+	{"mail_file", "CHIRPY_MAIL_FILE", "mail-file", "file email is appended to when mailer is file", setString(func(c *config) *string { return &c.MailFile })},
+	{"smtp_addr", "CHIRPY_SMTP_ADDR", "smtp-addr", "host:port of the SMTP relay when mailer is smtp", setString(func(c *config) *string { return &c.SMTPAddr })},
+	{"smtp_username", "CHIRPY_SMTP_USERNAME", "smtp-username", "SMTP username; leave empty to send without authentication", setString(func(c *config) *string { return &c.SMTPUsername })},
+	{"smtp_password", "SMTP_PASSWORD", "", "SMTP password", setString(func(c *config) *string { return &c.SMTPPassword })},
+	{"max_chirp_length", "CHIRPY_MAX_CHIRP_LENGTH", "max-chirp-length", "maximum chirp length in bytes", setInt(func(c *config) *int { return &c.MaxChirpLength })},
+	{"max_body_bytes", "CHIRPY_MAX_BODY_BYTES", "max-body-bytes", "maximum request body size in bytes", setInt64(func(c *config) *int64 { return &c.MaxBodyBytes })},
+	{"rate_limit", "CHIRPY_RATE_LIMIT", "rate-limit", "apply per-route rate limits", setBool(func(c *config) *bool { return &c.RateLimit })},
+	{"tls_cert_file", "CHIRPY_TLS_CERT_FILE", "tls-cert", "TLS certificate file; enables HTTPS together with tls-key", setString(func(c *config) *string { return &c.TLSCertFile })},
+	{"tls_key_file", "CHIRPY_TLS_KEY_FILE", "tls-key", "TLS private key file", setString(func(c *config) *string { return &c.TLSKeyFile })},
+	{"http_redirect_addr", "CHIRPY_HTTP_REDIRECT_ADDR", "http-redirect-addr", "address of a plain HTTP listener that redirects to HTTPS", setString(func(c *config) *string { return &c.HTTPRedirectAddr })},
+	{"hsts_max_age", "CHIRPY_HSTS_MAX_AGE", "hsts-max-age", "max-age of the Strict-Transport-Security header on HTTPS responses, 0 to disable", setDuration(func(c *config) *time.Duration { return &c.HSTSMaxAge })},
+	{"log_level", "CHIRPY_LOG_LEVEL", "log-level", "minimum log level: debug, info, warn or error", setter{parse: func(c *config, value string) error {
+		return c.LogLevel.UnmarshalText([]byte(value))
+	}}},
+	{"trace_exporter", "CHIRPY_TRACE_EXPORTER", "trace-exporter", "where to send OpenTelemetry spans: none, stdout or file", setString(func(c *config) *string { return &c.TraceExporter })},
+	{"trace_file", "CHIRPY_TRACE_FILE", "trace-file", "file spans are appended to when trace_exporter is file", setString(func(c *config) *string { return &c.TraceFile })},
+	{"shutdown_timeout", "CHIRPY_SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long to wait for in-flight requests on shutdown", setDuration(func(c *config) *time.Duration { return &c.ShutdownTimeout })},
+	{"refresh_token_purge_interval", "CHIRPY_REFRESH_TOKEN_PURGE_INTERVAL", "refresh-token-purge-interval", "how often expired refresh tokens are deleted, 0 to disable", setDuration(func(c *config) *time.Duration { return &c.RefreshPurgeInterval })},
+	{"mail_token_purge_interval", "CHIRPY_MAIL_TOKEN_PURGE_INTERVAL", "mail-token-purge-interval", "how often expired password reset and email verification tokens are deleted, 0 to disable", setDuration(func(c *config) *time.Duration { return &c.MailPurgeInterval })},
+}
+
+func defaultConfig() config {
+	return config{
+		ListenAddr:              ":8080",
+		DataPath:                "database.json",
+		JWTAlgorithm:            "HS256",
+		AccessTokenTTL:          24 * time.Hour,
+		RefreshedAccessTokenTTL: time.Hour,
+		RefreshTokenTTL:         60 * 24 * time.Hour,
+		PasswordHasher:          "bcrypt",
+		BcryptCost:              bcrypt.DefaultCost,
+		Argon2Memory:            19 * 1024,
+		Argon2Iterations:        2,
+		Argon2Parallelism:       1,
+		PasswordMinLength:       8,
+		PasswordRejectCommon:    true,
+		LoginLockoutThreshold:   5,
+		LoginIPLockoutThreshold: 20,
+		LoginLockoutDuration:    15 * time.Minute,
+		PasswordResetTTL:        time.Hour,
+		EmailVerificationTTL:    24 * time.Hour,
+		Mailer:                  "log",
+		MailFrom:                "chirpy@localhost",
+		MailFile:                "mail.txt",
+		MaxChirpLength:          140,
+		MaxBodyBytes:            1 << 20,
+		RateLimit:               true,
+		HSTSMaxAge:              2 * 365 * 24 * time.Hour,
+		ShutdownTimeout:         30 * time.Second,
+		RefreshPurgeInterval:    time.Hour,
+		MailPurgeInterval:       time.Hour,
+		TraceExporter:           "none",
+		TraceFile:               "traces.json",
+	}
+}
+
+// loadConfig builds the configuration from command line arguments, the
+// process environment and an optional config file. All problems found are
+// returned together.
+func loadConfig(args []string, getenv func(string) string) (config, error) {
+	cfg := defaultConfig()
+
+	flags := flag.NewFlagSet("chirpy", flag.ContinueOnError)
+	debug := flags.Bool("debug", false, "remove the database file before starting")
+	configPath := flags.String("config", "", "path to a YAML or TOML config file (env CHIRPY_CONFIG)")
+	envFile := flags.String("env-file", ".env", "path to an optional .env file")
+	flagValues := make(map[string]*settingFlag)
+	for _, field := range configFields {
+		if field.flag != "" {
+			flagValues[field.flag] = &settingFlag{boolean: field.set.boolean}
+			flags.Var(flagValues[field.flag], field.flag, fmt.Sprintf("%s (env %s)", field.usage, field.env))
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return config{}, err
+	}
+	cfg.Debug = *debug
+
+	var errs []error
+
+	// A missing .env is fine; the variables may come from the real
+	// environment instead.
+	dotenv, err := godotenv.Read(*envFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		errs = append(errs, fmt.Errorf("reading %s: %w", *envFile, err))
+	}
+	lookupEnv := func(key string) string {
+		if value := getenv(key); value != "" {
+			return value
+		}
+		return dotenv[key]
+	}
+
+	if *configPath == "" {
+		*configPath = lookupEnv("CHIRPY_CONFIG")
+	}
+	if *configPath != "" {
+		values, err := readConfigFile(*configPath)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, field := range configFields {
+			if value, ok := values[field.key]; ok {
+				if err := field.set.parse(&cfg, value); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %s: %w", *configPath, field.key, err))
+				}
+			}
+		}
+	}
+
+	for _, field := range configFields {
+		if value := lookupEnv(field.env); value != "" {
+			if err := field.set.parse(&cfg, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", field.env, err))
+			}
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		for _, field := range configFields {
+			if field.flag == f.Name {
+				if err := field.set.parse(&cfg, flagValues[f.Name].value); err != nil {
+					errs = append(errs, fmt.Errorf("-%s: %w", f.Name, err))
+				}
+			}
+		}
+	})
+
+	errs = append(errs, cfg.validate()...)
+
+	return cfg, errors.Join(errs...)
+}
+
+func (c config) validate() []error {
+	var errs []error
+
+	if c.ListenAddr == "" {
+		errs = append(errs, errors.New("listen_addr must not be empty"))
+	}
+	if c.PublicURL != "" {
+		u, err := url.Parse(c.PublicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+			errs = append(errs, errors.New("public_url must be an http or https URL without a path, like https://chirpy.example.com"))
+		}
+	}
+	if c.DataPath == "" {
+		errs = append(errs, errors.New("data_path must not be empty"))
+	}
+	// With RS256 or EdDSA the secret only derives the two-factor
+	// encryption key.
+	if c.JWTSecret == "" && (c.JWTAlgorithm == "HS256" || c.TOTPEncryptionKey == "") {
+		errs = append(errs, errors.New("JWT_SECRET is not set"))
+	}
+	switch c.JWTAlgorithm {
+	case "HS256":
+	case "RS256", "EdDSA":
+		if c.JWTPrivateKeyFile == "" {
+			errs = append(errs, fmt.Errorf("jwt_private_key_file must be set when jwt_algorithm is %s", c.JWTAlgorithm))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("jwt_algorithm %q is not one of %s", c.JWTAlgorithm, strings.Join(jwtAlgorithms, ", ")))
+	}
+	if c.PolkaAPIKey == "" {
+		errs = append(errs, errors.New("POLKA_API_KEY is not set"))
+	}
+	if c.AccessTokenTTL <= 0 {
+		errs = append(errs, errors.New("access_token_ttl must be positive"))
+	}
+	if c.RefreshedAccessTokenTTL <= 0 {
+		errs = append(errs, errors.New("refreshed_access_token_ttl must be positive"))
+	}
+	if c.RefreshTokenTTL <= 0 {
+		errs = append(errs, errors.New("refresh_token_ttl must be positive"))
+	}
+	if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+		errs = append(errs, fmt.Errorf("bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost))
+	}
+	if _, ok := passwordHashers[c.PasswordHasher]; !ok {
+		errs = append(errs, fmt.Errorf("password_hasher %q is not one of %s", c.PasswordHasher, strings.Join(passwordHasherNames(), ", ")))
+	}
+	if c.Argon2Parallelism < 1 || c.Argon2Parallelism > 255 {
+		errs = append(errs, errors.New("argon2_parallelism must be between 1 and 255"))
+	}
+	if c.Argon2Memory < 8*c.Argon2Parallelism {
+		errs = append(errs, errors.New("argon2_memory must be at least 8 KiB per unit of argon2_parallelism"))
+	}
+	if c.Argon2Iterations < 1 {
+		errs = append(errs, errors.New("argon2_iterations must be positive"))
+	}
+	if c.PasswordMinLength < 1 || c.PasswordMinLength > 72 {
+		errs = append(errs, errors.New("password_min_length must be between 1 and 72"))
+	}
+	if c.LoginLockoutThreshold <= 0 {
+		errs = append(errs, errors.New("login_lockout_threshold must be positive"))
+	}
+	if c.LoginIPLockoutThreshold <= 0 {
+		errs = append(errs, errors.New("login_ip_lockout_threshold must be positive"))
+	}
+	if c.LoginLockoutDuration <= 0 {
+		errs = append(errs, errors.New("login_lockout_duration must be positive"))
+	}
+	if c.PasswordResetTTL <= 0 {
+		errs = append(errs, errors.New("password_reset_ttl must be positive"))
+	}
+	if c.EmailVerificationTTL <= 0 {
+		errs = append(errs, errors.New("email_verification_ttl must be positive"))
+	}
+	if _, ok := mailers[c.Mailer]; !ok {
+		errs = append(errs, fmt.Errorf("mailer %q is not one of %s", c.Mailer, strings.Join(mailerNames(), ", ")))
+	}
+	if c.MailFrom == "" {
+		errs = append(errs, errors.New("mail_from must not be empty"))
+	}
+	if c.Mailer == "file" && c.MailFile == "" {
+		errs = append(errs, errors.New("mail_file must be set when mailer is file"))
+	}
+	if c.Mailer == "smtp" && c.SMTPAddr == "" {
+		errs = append(errs, errors.New("smtp_addr must be set when mailer is smtp"))
+	}
+	if c.MaxChirpLength <= 0 {
+		errs = append(errs, errors.New("max_chirp_length must be positive"))
+	}
+	if c.MaxBodyBytes <= 0 {
+		errs = append(errs, errors.New("max_body_bytes must be positive"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout must be positive"))
+	}
+	if c.RefreshPurgeInterval < 0 {
+		errs = append(errs, errors.New("refresh_token_purge_interval must not be negative"))
+	}
+	if c.MailPurgeInterval < 0 {
+		errs = append(errs, errors.New("mail_token_purge_interval must not be negative"))
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("tls_cert_file and tls_key_file must be set together"))
+	}
+	if c.HTTPRedirectAddr != "" && c.TLSCertFile == "" {
+		errs = append(errs, errors.New("http_redirect_addr requires tls_cert_file and tls_key_file"))
+	}
+	if c.HSTSMaxAge < 0 {
+		errs = append(errs, errors.New("hsts_max_age must not be negative"))
+	}
+	if _, ok := traceExporters[c.TraceExporter]; !ok && c.TraceExporter != "none" {
+		errs = append(errs, fmt.Errorf("trace_exporter %q is not one of none, %s", c.TraceExporter, strings.Join(traceExporterNames(), ", ")))
+	}
+	if c.TraceExporter == "file" && c.TraceFile == "" {
+		errs = append(errs, errors.New("trace_file must be set when trace_exporter is file"))
+	}
+	for _, path := range []string{c.TLSCertFile, c.TLSKeyFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("TLS file: %w", err))
+		}
+	}
+
+	return errs
+}
+
+// totpKeys returns the key TOTP secrets are encrypted with and the keys
+// they may have been encrypted with before. Without totp_encryption_key the
+// key is derived from jwt_secret, so it changes when the secret is rotated;
+// the retired secrets in jwt_previous_secrets keep older values readable.
+func (c config) totpKeys() (string, []string) {
+	var previous []string
+	for _, secret := range splitList(c.JWTPreviousSecrets) {
+		previous = append(previous, "chirpy-totp:"+secret)
+	}
+	if c.TOTPEncryptionKey != "" {
+		if c.JWTSecret != "" {
+			previous = append(previous, "chirpy-totp:"+c.JWTSecret)
+		}
+		return c.TOTPEncryptionKey, previous
+	}
+	return "chirpy-totp:" + c.JWTSecret, previous
+}
+
+// baseURL is the externally visible scheme and host of the server. Links
+// are never built from the request's Host header, which clients control
+// and shared caches would keep.
+func (c config) baseURL() string {
+	if c.PublicURL != "" {
+		return strings.TrimRight(c.PublicURL, "/")
+	}
+
+	scheme := "http"
+	if c.TLSCertFile != "" {
+		scheme = "https"
+	}
+	host, port, err := net.SplitHostPort(c.ListenAddr)
+	if err != nil {
+		return scheme + "://" + c.ListenAddr
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// readConfigFile reads a flat YAML or TOML file, chosen by extension, into
+// string values keyed by setting name.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	defer f.Close()
+
+	raw := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.NewDecoder(f).Decode(&raw)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	case ".toml":
+		_, err = toml.NewDecoder(f).Decode(&raw)
+	default:
+		return nil, fmt.Errorf("config file %s: unsupported format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	known := make(map[string]bool, len(configFields))
+	for _, field := range configFields {
+		known[field.key] = true
+	}
+
+	values := make(map[string]string, len(raw))
+	var unknown []string
+	for key, value := range raw {
+		if !known[key] {
+			unknown = append(unknown, key)
+			continue
+		}
+		values[key] = fmt.Sprint(value)
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return values, fmt.Errorf("%s: unknown settings: %s", path, strings.Join(unknown, ", "))
+	}
+
+	return values, nil
+}
+
+func setString(field func(*config) *string) setter {
+	return setter{parse: func(c *config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func setDuration(field func(*config) *time.Duration) setter {
+	return setter{parse: func(c *config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		*field(c) = d
+		return nil
+	}}
+}
+
+func setInt(field func(*config) *int) setter {
+	return setter{parse: func(c *config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func setBool(field func(*config) *bool) setter {
+	return setter{parse: func(c *config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		*field(c) = b
+		return nil
+	}, boolean: true}
+}
+
+func setInt64(field func(*config) *int64) setter {
+	return setter{parse: func(c *config, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*field(c) = n
+		return nil
+	}}
+}
@@ -0,0 +1,254 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IntegrityIssue describes an inconsistency found by CheckIntegrity.
+type IntegrityIssue struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// Counts returns the number of chirps and users in the store.
+func Counts() (chirps, users int) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	if db == nil {
+		return 0, 0
+	}
+	return len(db.Chirps), len(db.Users)
+}
+
+func GetUsers(ctx context.Context) ([]User, error) {
+	ctx, end := startOp(ctx, "get_users")
+	defer end()
+	defer rlock(ctx)()
+
+	users := make([]User, 0, len(db.Users))
+	for _, user := range db.Users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+
+	return users, nil
+}
+
+// SearchUsers returns users whose email contains query, ignoring case.
+func SearchUsers(ctx context.Context, query string) ([]User, error) {
+	users, err := GetUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	query = strings.ToLower(query)
+	matches := make([]User, 0)
+	for _, user := range users {
+		if strings.Contains(strings.ToLower(user.Email), query) {
+			matches = append(matches, user)
+		}
+	}
+
+	return matches, nil
+}
+
+func SetChirpyRed(ctx context.Context, userID int, isChirpyRed bool) error {
+	ctx, end := startOp(ctx, "set_chirpy_red")
+	defer end()
+	defer lock(ctx)()
+
+	user, ok := db.Users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	user.IsChirpyRed = isChirpyRed
+	db.Users[userID] = user
+
+	return saveDatabase(ctx)
+}
+
+func SetRole(ctx context.Context, userID int, role Role) error {
+	ctx, end := startOp(ctx, "set_role")
+	defer end()
+	defer lock(ctx)()
+
+	if _, err := ParseRole(string(role)); err != nil {
+		return err
+	}
+
+	user, ok := db.Users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	user.Role = role
+	db.Users[userID] = user
+
+	return saveDatabase(ctx)
+}
+
+// BootstrapAdmin makes the user with the given email an admin, but only
+// while no admin exists yet and only once they have verified the address,
+// so whoever signs up with it first can't claim the role. It reports
+// whether the user was promoted.
+func BootstrapAdmin(ctx context.Context, email string) (bool, error) {
+	ctx, end := startOp(ctx, "bootstrap_admin")
+	defer end()
+	defer lock(ctx)()
+
+	var candidate *User
+	for _, user := range db.Users {
+		if user.Role == RoleAdmin {
+			return false, nil
+		}
+		if emailKey(user.Email) == emailKey(email) {
+			user := user
+			candidate = &user
+		}
+	}
+	if candidate == nil {
+		return false, ErrUserNotFound
+	}
+	if !candidate.Verified {
+		return false, ErrEmailNotVerified
+	}
+
+	candidate.Role = RoleAdmin
+	db.Users[candidate.ID] = *candidate
+
+	return true, saveDatabase(ctx)
+}
+
+// PurgeExpiredRefreshTokens removes refresh tokens that expired before now
+// and returns how many were removed.
+func PurgeExpiredRefreshTokens(ctx context.Context, now time.Time) (int, error) {
+	ctx, end := startOp(ctx, "purge_expired_refresh_tokens")
+	defer end()
+	defer lock(ctx)()
+
+	removed := 0
+	for key, token := range db.RefreshTokens {
+		if token.ExpiresAt.Before(now) {
+			delete(db.RefreshTokens, key)
+			removed++
+		}
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+
+	return removed, saveDatabase(ctx)
+}
+
+// PurgeExpiredMailTokens removes password resets and email verifications
+// that expired before now and returns how many were removed.
+func PurgeExpiredMailTokens(ctx context.Context, now time.Time) (int, error) {
+	ctx, end := startOp(ctx, "purge_expired_mail_tokens")
+	defer end()
+	defer lock(ctx)()
+
+	removed := 0
+	for key, reset := range db.PasswordResets {
+		if reset.ExpiresAt.Before(now) {
+			delete(db.PasswordResets, key)
+			removed++
+		}
+	}
+	for key, verification := range db.EmailVerifications {
+		if verification.ExpiresAt.Before(now) {
+			delete(db.EmailVerifications, key)
+			removed++
+		}
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+
+	return removed, saveDatabase(ctx)
+}
+
+// CheckIntegrity looks for inconsistencies that the API never produces but
+// hand edits of the database file can: dangling references, mismatched keys,
+// duplicate emails and ID counters that would hand out existing IDs.
+func CheckIntegrity(ctx context.Context) ([]IntegrityIssue, error) {
+	ctx, end := startOp(ctx, "check_integrity")
+	defer end()
+	defer rlock(ctx)()
+
+	issues := make([]IntegrityIssue, 0)
+	add := func(kind, format string, args ...interface{}) {
+		issues = append(issues, IntegrityIssue{Kind: kind, Message: fmt.Sprintf(format, args...)})
+	}
+
+	maxChirpID := 0
+	for key, chirp := range db.Chirps {
+		if key != chirp.ID {
+			add("chirp_key_mismatch", "chirp stored under key %d has id %d", key, chirp.ID)
+		}
+		if _, ok := db.Users[chirp.AuthorID]; !ok {
+			add("dangling_author", "chirp %d has author_id %d which does not exist", key, chirp.AuthorID)
+		}
+		if key > maxChirpID {
+			maxChirpID = key
+		}
+	}
+	if db.NextID <= maxChirpID {
+		add("next_id_too_low", "next_id is %d but the highest chirp id is %d", db.NextID, maxChirpID)
+	}
+
+	maxUserID := 0
+	emails := make(map[string]int)
+	for key, user := range db.Users {
+		if key != user.ID {
+			add("user_key_mismatch", "user stored under key %d has id %d", key, user.ID)
+		}
+		if other, ok := emails[emailKey(user.Email)]; ok {
+			add("duplicate_email", "users %d and %d share the email %q", other, key, user.Email)
+		}
+		emails[emailKey(user.Email)] = key
+		if _, err := ParseRole(string(user.Role)); err != nil {
+			add("invalid_role", "user %d has unknown role %q", key, user.Role)
+		}
+		if key > maxUserID {
+			maxUserID = key
+		}
+	}
+	if db.NextUserID <= maxUserID {
+		add("next_user_id_too_low", "next_user_id is %d but the highest user id is %d", db.NextUserID, maxUserID)
+	}
+
+	for key, token := range db.RefreshTokens {
+		if key != token.TokenHash {
+			add("refresh_token_key_mismatch", "refresh token stored under key %s... has a different token_hash", truncate(key, 8))
+		}
+		if _, ok := db.Users[token.UserID]; !ok {
+			add("dangling_refresh_token", "refresh token %s... belongs to user %d which does not exist", truncate(key, 8), token.UserID)
+		}
+	}
+
+	sort.Slice(issues, func(i, j int) bool {
+		if issues[i].Kind != issues[j].Kind {
+			return issues[i].Kind < issues[j].Kind
+		}
+		return issues[i].Message < issues[j].Message
+	})
+
+	return issues, nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
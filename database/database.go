@@ -1,25 +1,50 @@
 package database
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"log"
 	"os"
 	"sync"
 	"time"
 )
-import "golang.org/x/crypto/bcrypt"
 
 const databaseFile = "database.json"
 
 var (
-	db      *Database
-	once    sync.Once
-	dbMutex sync.RWMutex
+	db           *Database
+	once         sync.Once
+	dbMutex      sync.RWMutex
+	databasePath = databaseFile
+
+	maxChirpLength = 140
+
+	closed bool
+
+	observer func(op string, d time.Duration)
 )
 
+// SetObserver registers a function that is told how long each store
+// operation took, including time spent waiting for the lock. It must be
+// called before Init.
+func SetObserver(fn func(op string, d time.Duration)) {
+	observer = fn
+}
+
+// SetMaxChirpLength sets the longest chirp body CreateChirp accepts.
+func SetMaxChirpLength(length int) {
+	maxChirpLength = length
+}
+
+// SetPath changes the file the database is loaded from and saved to. It must
+// be called before Init.
+func SetPath(path string) {
+	databasePath = path
+}
+
 func Init() error {
 	var err error
 	once.Do(func() {
@@ -29,7 +54,7 @@ func Init() error {
 }
 
 func RemoveDatabase() error {
-	err := os.Remove(databaseFile)
+	err := os.Remove(databasePath)
 	if err != nil && !os.IsNotExist(err) {
 		log.Fatalf("Failed to remove database file: %v", err)
 		return err
@@ -39,10 +64,11 @@ func RemoveDatabase() error {
 }
 
 func loadDatabase() error {
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
+	ctx, end := startOp(context.Background(), "load")
+	defer end()
+	defer lock(ctx)()
 
-	_, err := os.Stat(databaseFile)
+	info, err := os.Stat(databasePath)
 	if os.IsNotExist(err) {
 		db = &Database{
 			Chirps:        make(map[int]Chirp),
@@ -51,10 +77,14 @@ func loadDatabase() error {
 			NextUserID:    1,
 			RefreshTokens: make(map[string]RefreshToken),
 		}
+		initMaps()
 		return nil
 	}
+	if err != nil {
+		return err
+	}
 
-	data, err := os.ReadFile(databaseFile)
+	data, err := os.ReadFile(databasePath)
 	if err != nil {
 		return err
 	}
@@ -64,12 +94,88 @@ func loadDatabase() error {
 		return err
 	}
 
+	initMaps()
+	upgradeUsers()
+	upgradeChirps(info.ModTime())
+	return upgradeRefreshTokens()
+}
+
+// initMaps fills in maps that are missing from database files written by
+// older versions.
+func initMaps() {
+	if db.RefreshTokens == nil {
+		db.RefreshTokens = make(map[string]RefreshToken)
+	}
+	if db.ActorKeys == nil {
+		db.ActorKeys = make(map[int]string)
+	}
+	if db.Followers == nil {
+		db.Followers = make(map[int][]Follower)
+	}
+	if db.Following == nil {
+		db.Following = make(map[int][]Followee)
+	}
+	if db.Likes == nil {
+		db.Likes = make(map[int][]string)
+	}
+	if db.RemoteNotes == nil {
+		db.RemoteNotes = make(map[string]RemoteNote)
+	}
+	if db.PasswordResets == nil {
+		db.PasswordResets = make(map[string]PasswordReset)
+	}
+	if db.EmailVerifications == nil {
+		db.EmailVerifications = make(map[string]EmailVerification)
+	}
+}
+
+// upgradeRefreshTokens hashes refresh tokens stored in plain text by older
+// versions, whose map keys are the tokens themselves. Each becomes its own
+// family.
+func upgradeRefreshTokens() error {
+	for key, refreshToken := range db.RefreshTokens {
+		if refreshToken.TokenHash != "" {
+			continue
+		}
+
+		familyID, err := randomHex(16)
+		if err != nil {
+			return err
+		}
+		refreshToken.TokenHash = hashRefreshToken(key)
+		refreshToken.FamilyID = familyID
+		delete(db.RefreshTokens, key)
+		db.RefreshTokens[refreshToken.TokenHash] = refreshToken
+	}
 	return nil
 }
 
-func GetChirps() ([]Chirp, error) {
-	dbMutex.RLock()
-	defer dbMutex.RUnlock()
+// upgradeChirps dates chirps stored before creation times were recorded.
+// The file's modification time is the latest any of them can have been
+// posted, and keeps them ordered before chirps posted from now on.
+func upgradeChirps(modTime time.Time) {
+	for id, chirp := range db.Chirps {
+		if chirp.CreatedAt.IsZero() {
+			chirp.CreatedAt = modTime.UTC()
+			db.Chirps[id] = chirp
+		}
+	}
+}
+
+// upgradeUsers gives users created before roles existed the default role.
+func upgradeUsers() {
+	for id, user := range db.Users {
+		if user.Role == "" {
+			user.Role = RoleUser
+			db.Users[id] = user
+		}
+	}
+}
+
+func GetChirps(ctx context.Context) ([]Chirp, error) {
+	ctx, end := startOp(ctx, "get_chirps")
+	defer end()
+	defer rlock(ctx)()
 
 	chirps := make([]Chirp, 0, len(db.Chirps))
 	for _, chirp := range db.Chirps {
@@ -79,9 +185,10 @@ func GetChirps() ([]Chirp, error) {
 	return chirps, nil
 }
 
-func GetChirpsByAuthorID(authorID int) ([]Chirp, error) {
-	dbMutex.RLock()
-	defer dbMutex.RUnlock()
+func GetChirpsByAuthorID(ctx context.Context, authorID int) ([]Chirp, error) {
+	ctx, end := startOp(ctx, "get_chirps_by_author")
+	defer end()
+	defer rlock(ctx)()
 
 	chirps := make([]Chirp, 0)
 	for _, chirp := range db.Chirps {
@@ -93,9 +200,10 @@ func GetChirpsByAuthorID(authorID int) ([]Chirp, error) {
 	return chirps, nil
 }
 
-func GetChirpByID(id int) (Chirp, error) {
-	dbMutex.RLock()
-	defer dbMutex.RUnlock()
+func GetChirpByID(ctx context.Context, id int) (Chirp, error) {
+	ctx, end := startOp(ctx, "get_chirp")
+	defer end()
+	defer rlock(ctx)()
 
 	chirp, ok := db.Chirps[id]
 	if !ok {
@@ -105,25 +213,27 @@ func GetChirpByID(id int) (Chirp, error) {
 	return chirp, nil
 }
 
-func CreateChirp(body string, userId int) (Chirp, error) {
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
+func CreateChirp(ctx context.Context, body string, userId int) (Chirp, error) {
+	ctx, end := startOp(ctx, "create_chirp")
+	defer end()
+	defer lock(ctx)()
 
 	cleanedBody := replaceProfaneWords(body)
-	if len(cleanedBody) > 140 {
+	if len(cleanedBody) > maxChirpLength {
 		return Chirp{}, ErrChirpTooLong
 	}
 
 	chirp := Chirp{
-		ID:       db.NextID,
-		Body:     cleanedBody,
-		AuthorID: userId,
+		ID:        db.NextID,
+		Body:      cleanedBody,
+		AuthorID:  userId,
+		CreatedAt: time.Now().UTC(),
 	}
 
 	db.Chirps[chirp.ID] = chirp
 	db.NextID++
 
-	err := saveDatabase()
+	err := saveDatabase(ctx)
 	if err != nil {
 		return Chirp{}, err
 	}
@@ -131,9 +241,10 @@ func CreateChirp(body string, userId int) (Chirp, error) {
 	return chirp, nil
 }
 
-func DeleteChirp(id int) error {
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
+func DeleteChirp(ctx context.Context, id int) error {
+	ctx, end := startOp(ctx, "delete_chirp")
+	defer end()
+	defer lock(ctx)()
 
 	_, ok := db.Chirps[id]
 	if !ok {
@@ -141,8 +252,9 @@ func DeleteChirp(id int) error {
 	}
 
 	delete(db.Chirps, id)
+	delete(db.Likes, id)
 
-	err := saveDatabase()
+	err := saveDatabase(ctx)
 	if err != nil {
 		return err
 	}
@@ -150,27 +262,73 @@ func DeleteChirp(id int) error {
 	return nil
 }
 
-func saveDatabase() error {
+func saveDatabase(ctx context.Context) error {
+	_, end := startOp(ctx, "save")
+	defer end()
+
+	if closed {
+		return ErrDatabaseClosed
+	}
+
 	data, err := json.MarshalIndent(db, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(databaseFile, data, 0644)
+	// Write to a temporary file and rename it over the database so a crash
+	// mid-write never leaves a truncated file behind.
+	tmp := databasePath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, databasePath)
 }
 
-func CreateUser(email, password string) (User, error) {
+// Close waits for in-progress writes to finish, saves the database a final
+// time and makes later writes fail with ErrDatabaseClosed.
+func Close() error {
 	dbMutex.Lock()
 	defer dbMutex.Unlock()
 
-	// moved here as got a write lock error using the function - need to fix
-	for _, existingUser := range db.Users {
-		if existingUser.Email == email {
-			return User{}, ErrUserExists
-		}
+	if db == nil || closed {
+		return nil
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	err := saveDatabase(context.Background())
+	closed = true
+	return err
+}
+
+func CreateUser(ctx context.Context, email, password string) (User, error) {
+	ctx, end := startOp(ctx, "create_user")
+	defer end()
+	defer lock(ctx)()
+
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return User{}, err
+	}
+	if emailTaken(email, 0) {
+		return User{}, ErrUserExists
+	}
+	if err := CheckPassword(password, email); err != nil {
+		return User{}, err
+	}
+
+	hashedPassword, err := HashPassword(ctx, password)
 	if err != nil {
 		return User{}, err
 	}
@@ -178,14 +336,16 @@ func CreateUser(email, password string) (User, error) {
 	user := User{
 		ID:          db.NextUserID,
 		Email:       email,
-		Password:    string(hashedPassword),
+		Password:    hashedPassword,
 		IsChirpyRed: false,
+		Role:        RoleUser,
+		Verified:    false,
 	}
 
 	db.Users[user.ID] = user
 	db.NextUserID++
 
-	err = saveDatabase()
+	err = saveDatabase(ctx)
 	if err != nil {
 		return User{}, err
 	}
@@ -193,9 +353,10 @@ func CreateUser(email, password string) (User, error) {
 	return user, nil
 }
 
-func UpgradeUserToChirpyRed(userID int) error {
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
+func UpgradeUserToChirpyRed(ctx context.Context, userID int) error {
+	ctx, end := startOp(ctx, "upgrade_user")
+	defer end()
+	defer lock(ctx)()
 
 	user, ok := db.Users[userID]
 	if !ok {
@@ -205,7 +366,7 @@ func UpgradeUserToChirpyRed(userID int) error {
 	user.IsChirpyRed = true
 	db.Users[userID] = user
 
-	err := saveDatabase()
+	err := saveDatabase(ctx)
 	if err != nil {
 		return err
 	}
@@ -213,12 +374,26 @@ func UpgradeUserToChirpyRed(userID int) error {
 	return nil
 }
 
-func GetUserByEmail(email string) (User, error) {
-	dbMutex.RLock()
-	defer dbMutex.RUnlock()
+func GetUserByID(ctx context.Context, id int) (User, error) {
+	ctx, end := startOp(ctx, "get_user")
+	defer end()
+	defer rlock(ctx)()
+
+	user, ok := db.Users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	return user, nil
+}
+
+func GetUserByEmail(ctx context.Context, email string) (User, error) {
+	ctx, end := startOp(ctx, "get_user_by_email")
+	defer end()
+	defer rlock(ctx)()
 
 	for _, user := range db.Users {
-		if user.Email == email {
+		if emailKey(user.Email) == emailKey(email) {
 			return user, nil
 		}
 	}
@@ -226,9 +401,13 @@ func GetUserByEmail(email string) (User, error) {
 	return User{}, ErrUserNotFound
 }
 
-func UpdateUser(id int, email, password string) (User, error) {
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
+// UpdateUser changes a user's password and requests an email change. A new
+// email is only stored as PendingEmail; it replaces Email once VerifyEmail
+// confirms it. Asking for the current email cancels a pending change.
+func UpdateUser(ctx context.Context, id int, email, password string) (User, error) {
+	ctx, end := startOp(ctx, "update_user")
+	defer end()
+	defer lock(ctx)()
 
 	user, ok := db.Users[id]
 	if !ok {
@@ -236,20 +415,34 @@ func UpdateUser(id int, email, password string) (User, error) {
 	}
 
 	if email != "" {
-		user.Email = email
+		email, err := NormalizeEmail(email)
+		if err != nil {
+			return User{}, err
+		}
+		switch {
+		case emailKey(user.Email) == email:
+			user.PendingEmail = ""
+		case emailTaken(email, id):
+			return User{}, ErrUserExists
+		default:
+			user.PendingEmail = email
+		}
 	}
 
 	if password != "" {
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err := CheckPassword(password, user.Email, user.PendingEmail); err != nil {
+			return User{}, err
+		}
+		hashedPassword, err := HashPassword(ctx, password)
 		if err != nil {
 			return User{}, err
 		}
-		user.Password = string(hashedPassword)
+		user.Password = hashedPassword
 	}
 
 	db.Users[id] = user
 
-	err := saveDatabase()
+	err := saveDatabase(ctx)
 	if err != nil {
 		return User{}, err
 	}
@@ -257,56 +450,135 @@ func UpdateUser(id int, email, password string) (User, error) {
 	return user, nil
 }
 
-func CreateRefreshToken(userID int, expiresIn time.Duration) (string, error) {
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
 
-	token := make([]byte, 32)
-	_, err := rand.Read(token)
-	if err != nil {
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
+	return hex.EncodeToString(b), nil
+}
 
-	refreshToken := RefreshToken{
-		Token:     hex.EncodeToString(token),
-		UserID:    userID,
-		ExpiresAt: time.Now().Add(expiresIn),
+// addRefreshToken stores a new token with the given session details and
+// returns the token along with its record.
+func addRefreshToken(session RefreshToken) (string, RefreshToken, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", RefreshToken{}, err
 	}
 
-	db.RefreshTokens[refreshToken.Token] = refreshToken
+	session.TokenHash = hashRefreshToken(token)
+	session.RotatedAt = nil
+	db.RefreshTokens[session.TokenHash] = session
+	return token, session, nil
+}
+
+// CreateRefreshToken issues a refresh token starting a new family, as at
+// login.
+func CreateRefreshToken(ctx context.Context, userID int, expiresIn time.Duration, client SessionClient) (string, RefreshToken, error) {
+	ctx, end := startOp(ctx, "create_refresh_token")
+	defer end()
+	defer lock(ctx)()
 
-	err = saveDatabase()
+	familyID, err := randomHex(16)
 	if err != nil {
-		return "", err
+		return "", RefreshToken{}, err
+	}
+	now := time.Now()
+	token, refreshToken, err := addRefreshToken(RefreshToken{
+		UserID:     userID,
+		FamilyID:   familyID,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+		ExpiresAt:  now.Add(expiresIn),
+	})
+	if err != nil {
+		return "", RefreshToken{}, err
 	}
 
-	return refreshToken.Token, nil
+	err = saveDatabase(ctx)
+	if err != nil {
+		return "", RefreshToken{}, err
+	}
+
+	return token, refreshToken, nil
 }
 
-func GetRefreshToken(token string) (RefreshToken, error) {
-	dbMutex.RLock()
-	defer dbMutex.RUnlock()
+// RotateRefreshToken uses up a refresh token and issues its replacement in
+// the same family, expiring when the family would have. If the token was
+// already used, every token in its family is revoked and
+// ErrRefreshTokenReused is returned along with the used token's record.
+func RotateRefreshToken(ctx context.Context, token string, client SessionClient) (string, RefreshToken, error) {
+	ctx, end := startOp(ctx, "rotate_refresh_token")
+	defer end()
+	defer lock(ctx)()
+
+	hash := hashRefreshToken(token)
+	refreshToken, ok := db.RefreshTokens[hash]
+	now := time.Now()
+	if !ok || now.After(refreshToken.ExpiresAt) {
+		return "", RefreshToken{}, ErrRefreshTokenNotFound
+	}
 
-	refreshToken, ok := db.RefreshTokens[token]
-	if !ok {
-		return RefreshToken{}, errors.New("refresh token not found")
+	if refreshToken.RotatedAt != nil {
+		deleteRefreshTokenFamily(refreshToken.FamilyID)
+		err := saveDatabase(ctx)
+		if err != nil {
+			return "", RefreshToken{}, err
+		}
+		return "", refreshToken, ErrRefreshTokenReused
 	}
 
-	return refreshToken, nil
+	next := refreshToken
+	next.LastUsedAt = now
+	next.UserAgent = client.UserAgent
+	next.IP = client.IP
+
+	refreshToken.RotatedAt = &now
+	db.RefreshTokens[hash] = refreshToken
+
+	newToken, next, err := addRefreshToken(next)
+	if err != nil {
+		return "", RefreshToken{}, err
+	}
+
+	err = saveDatabase(ctx)
+	if err != nil {
+		return "", RefreshToken{}, err
+	}
+
+	return newToken, next, nil
 }
 
-func DeleteRefreshToken(token string) error {
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
+func deleteRefreshTokenFamily(familyID string) {
+	for hash, refreshToken := range db.RefreshTokens {
+		if refreshToken.FamilyID == familyID {
+			delete(db.RefreshTokens, hash)
+		}
+	}
+}
 
-	_, ok := db.RefreshTokens[token]
-	if !ok {
-		return errors.New("refresh token not found")
+// DeleteRefreshToken revokes a refresh token along with the rest of its
+// family, ending the session it belongs to.
+func DeleteRefreshToken(ctx context.Context, token string) error {
+	ctx, end := startOp(ctx, "delete_refresh_token")
+	defer end()
+	defer lock(ctx)()
+
+	refreshToken, ok := db.RefreshTokens[hashRefreshToken(token)]
+	if !ok || refreshToken.RotatedAt != nil {
+		return ErrRefreshTokenNotFound
 	}
 
-	delete(db.RefreshTokens, token)
+	deleteRefreshTokenFamily(refreshToken.FamilyID)
 
-	err := saveDatabase()
+	err := saveDatabase(ctx)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The database is a package-wide singleton, so every test shares one store
+// in a temporary directory and creates its own users.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "chirpy-database-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	SetPath(filepath.Join(dir, databaseFile))
+	SetHasher(BcryptHasher{Cost: bcrypt.MinCost})
+	if err := Init(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+var testUsers atomic.Int64
+
+func newTestUser(t *testing.T) User {
+	t.Helper()
+	email := fmt.Sprintf("user%d@example.com", testUsers.Add(1))
+	user, err := CreateUser(context.Background(), email, "blue sky meth lab")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	return user
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	ctx := context.Background()
+	user := newTestUser(t)
+	laptop := SessionClient{UserAgent: "laptop", IP: "203.0.113.1"}
+	phone := SessionClient{UserAgent: "phone", IP: "198.51.100.7"}
+
+	first, created, err := CreateRefreshToken(ctx, user.ID, time.Hour, laptop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, rotated, err := RotateRefreshToken(ctx, first, phone)
+	if err != nil {
+		t.Fatalf("rotating a fresh token: %v", err)
+	}
+	if second == first {
+		t.Error("rotation returned the same token")
+	}
+	if rotated.FamilyID != created.FamilyID || !rotated.ExpiresAt.Equal(created.ExpiresAt) || !rotated.CreatedAt.Equal(created.CreatedAt) {
+		t.Errorf("rotated token %+v does not continue session %+v", rotated, created)
+	}
+	if rotated.UserAgent != phone.UserAgent || rotated.IP != phone.IP {
+		t.Errorf("rotated token client = %q %q, want the phone's", rotated.UserAgent, rotated.IP)
+	}
+
+	third, _, err := RotateRefreshToken(ctx, second, phone)
+	if err != nil {
+		t.Fatalf("rotating the replacement: %v", err)
+	}
+
+	// Replaying a used token revokes the whole family, including the
+	// token the legitimate client holds now.
+	_, reused, err := RotateRefreshToken(ctx, first, laptop)
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("reusing a token: got %v, want ErrRefreshTokenReused", err)
+	}
+	if reused.UserID != user.ID || reused.FamilyID != created.FamilyID {
+		t.Errorf("reuse reported token %+v", reused)
+	}
+	for name, token := range map[string]string{"first": first, "second": second, "third": third} {
+		if _, _, err := RotateRefreshToken(ctx, token, laptop); !errors.Is(err, ErrRefreshTokenNotFound) {
+			t.Errorf("%s token after reuse: got %v, want ErrRefreshTokenNotFound", name, err)
+		}
+	}
+}
+
+func TestRotateRefreshTokenErrors(t *testing.T) {
+	ctx := context.Background()
+	user := newTestUser(t)
+
+	expired, _, err := CreateRefreshToken(ctx, user.ID, -time.Minute, SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, _, err := CreateRefreshToken(ctx, user.ID, time.Hour, SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteRefreshToken(ctx, revoked); err != nil {
+		t.Fatalf("DeleteRefreshToken: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"unknown", "not-a-token"},
+		{"expired", expired},
+		{"revoked", revoked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := RotateRefreshToken(ctx, tt.token, SessionClient{}); !errors.Is(err, ErrRefreshTokenNotFound) {
+				t.Errorf("got %v, want ErrRefreshTokenNotFound", err)
+			}
+		})
+	}
+}
+
+func TestDeleteRefreshToken(t *testing.T) {
+	ctx := context.Background()
+	user := newTestUser(t)
+
+	used, _, err := CreateRefreshToken(ctx, user.ID, time.Hour, SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _, err := RotateRefreshToken(ctx, used, SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := CreateRefreshToken(ctx, user.ID, time.Hour, SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the latest token in a family can log it out.
+	if err := DeleteRefreshToken(ctx, used); !errors.Is(err, ErrRefreshTokenNotFound) {
+		t.Errorf("deleting a used token: got %v, want ErrRefreshTokenNotFound", err)
+	}
+	if err := DeleteRefreshToken(ctx, current); err != nil {
+		t.Fatalf("deleting the current token: %v", err)
+	}
+	if _, _, err := RotateRefreshToken(ctx, current, SessionClient{}); !errors.Is(err, ErrRefreshTokenNotFound) {
+		t.Errorf("current token after delete: got %v, want ErrRefreshTokenNotFound", err)
+	}
+	if _, _, err := RotateRefreshToken(ctx, other, SessionClient{}); err != nil {
+		t.Errorf("another session was revoked too: %v", err)
+	}
+}
+
+func TestRefreshTokensStoredHashed(t *testing.T) {
+	user := newTestUser(t)
+	token, refreshToken, err := CreateRefreshToken(context.Background(), user.ID, time.Hour, SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(databasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), token) {
+		t.Error("database file contains the refresh token")
+	}
+	if !strings.Contains(string(data), refreshToken.TokenHash) {
+		t.Error("database file lacks the refresh token hash")
+	}
+}
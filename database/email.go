@@ -0,0 +1,113 @@
+package database
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const maxEmailLength = 254
+
+// NormalizeEmail checks that email is a bare address such as
+// walt@example.com and returns the form it is stored in. Addresses are
+// lowercased so that sign-up, login and lookups don't depend on case.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if len(email) > maxEmailLength {
+		return "", ErrInvalidEmail
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "", ErrInvalidEmail
+	}
+
+	return emailKey(email), nil
+}
+
+// emailKey is what emails are compared by. Users created before emails were
+// normalized may still have mixed case stored.
+func emailKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// emailTaken reports whether another user than exceptID has the email.
+func emailTaken(email string, exceptID int) bool {
+	for _, user := range db.Users {
+		if user.ID != exceptID && emailKey(user.Email) == emailKey(email) {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateEmailVerification stores a verification for an address of a user,
+// either their current email or a pending change, under the hash of its
+// token. Earlier verifications for the user stop working.
+func CreateEmailVerification(ctx context.Context, userID int, email, tokenHash string, expiresIn time.Duration) error {
+	ctx, end := startOp(ctx, "create_email_verification")
+	defer end()
+	defer lock(ctx)()
+
+	if _, ok := db.Users[userID]; !ok {
+		return ErrUserNotFound
+	}
+
+	now := time.Now()
+	for hash, v := range db.EmailVerifications {
+		if v.UserID == userID || now.After(v.ExpiresAt) {
+			delete(db.EmailVerifications, hash)
+		}
+	}
+
+	db.EmailVerifications[tokenHash] = EmailVerification{
+		UserID:    userID,
+		Email:     email,
+		ExpiresAt: now.Add(expiresIn),
+	}
+
+	return saveDatabase(ctx)
+}
+
+// VerifyEmail consumes an email verification. Verifying the current email
+// marks it verified; verifying a pending email makes it the user's email.
+// It fails with ErrUserExists if someone else took the address meanwhile.
+func VerifyEmail(ctx context.Context, tokenHash string) (User, error) {
+	ctx, end := startOp(ctx, "verify_email")
+	defer end()
+	defer lock(ctx)()
+
+	v, ok := db.EmailVerifications[tokenHash]
+	if !ok || time.Now().After(v.ExpiresAt) {
+		return User{}, ErrVerificationTokenInvalid
+	}
+	user, ok := db.Users[v.UserID]
+	if !ok {
+		return User{}, ErrVerificationTokenInvalid
+	}
+
+	switch v.Email {
+	case user.Email:
+	case user.PendingEmail:
+		if emailTaken(v.Email, user.ID) {
+			return User{}, ErrUserExists
+		}
+		user.Email = v.Email
+		user.PendingEmail = ""
+	default:
+		// The user has changed their email again since this was sent.
+		return User{}, ErrVerificationTokenInvalid
+	}
+
+	user.Verified = true
+	db.Users[user.ID] = user
+	delete(db.EmailVerifications, tokenHash)
+
+	err := saveDatabase(ctx)
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,286 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"sort"
+)
+
+// GetOrCreateActorKey returns the PEM encoded RSA private key used to sign
+// ActivityPub deliveries on behalf of a user, generating one on first use.
+func GetOrCreateActorKey(ctx context.Context, userID int) (string, error) {
+	ctx, end := startOp(ctx, "get_or_create_actor_key")
+	defer end()
+
+	unlock := rlock(ctx)
+	_, userExists := db.Users[userID]
+	key, ok := db.ActorKeys[userID]
+	unlock()
+	if !userExists {
+		return "", ErrUserNotFound
+	}
+	if ok {
+		return key, nil
+	}
+
+	// Key generation is slow, so it happens outside the lock.
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", err
+	}
+	generated := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	}))
+
+	defer lock(ctx)()
+
+	// Another request may have raced us to it.
+	if key, ok := db.ActorKeys[userID]; ok {
+		return key, nil
+	}
+
+	db.ActorKeys[userID] = generated
+
+	err = saveDatabase(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return generated, nil
+}
+
+func GetFollowers(ctx context.Context, userID int) ([]Follower, error) {
+	ctx, end := startOp(ctx, "get_followers")
+	defer end()
+	defer rlock(ctx)()
+
+	followers := make([]Follower, len(db.Followers[userID]))
+	copy(followers, db.Followers[userID])
+
+	return followers, nil
+}
+
+func AddFollower(ctx context.Context, userID int, follower Follower) error {
+	ctx, end := startOp(ctx, "add_follower")
+	defer end()
+	defer lock(ctx)()
+
+	if _, ok := db.Users[userID]; !ok {
+		return ErrUserNotFound
+	}
+
+	followers := db.Followers[userID]
+	for i, existing := range followers {
+		if existing.ActorID == follower.ActorID {
+			followers[i] = follower
+			return saveDatabase(ctx)
+		}
+	}
+
+	db.Followers[userID] = append(followers, follower)
+
+	return saveDatabase(ctx)
+}
+
+func RemoveFollower(ctx context.Context, userID int, actorID string) error {
+	ctx, end := startOp(ctx, "remove_follower")
+	defer end()
+	defer lock(ctx)()
+
+	followers := db.Followers[userID]
+	for i, existing := range followers {
+		if existing.ActorID == actorID {
+			db.Followers[userID] = append(followers[:i], followers[i+1:]...)
+			return saveDatabase(ctx)
+		}
+	}
+
+	return ErrNotFollowing
+}
+
+func GetFollowing(ctx context.Context, userID int) ([]Followee, error) {
+	ctx, end := startOp(ctx, "get_following")
+	defer end()
+	defer rlock(ctx)()
+
+	following := make([]Followee, len(db.Following[userID]))
+	copy(following, db.Following[userID])
+
+	return following, nil
+}
+
+func AddFollowing(ctx context.Context, userID int, followee Followee) error {
+	ctx, end := startOp(ctx, "add_following")
+	defer end()
+	defer lock(ctx)()
+
+	if _, ok := db.Users[userID]; !ok {
+		return ErrUserNotFound
+	}
+
+	following := db.Following[userID]
+	for i, existing := range following {
+		if existing.ActorID == followee.ActorID {
+			following[i] = followee
+			return saveDatabase(ctx)
+		}
+	}
+
+	db.Following[userID] = append(following, followee)
+
+	return saveDatabase(ctx)
+}
+
+func RemoveFollowing(ctx context.Context, userID int, actorID string) (Followee, error) {
+	ctx, end := startOp(ctx, "remove_following")
+	defer end()
+	defer lock(ctx)()
+
+	following := db.Following[userID]
+	for i, existing := range following {
+		if existing.ActorID == actorID {
+			db.Following[userID] = append(following[:i], following[i+1:]...)
+			return existing, saveDatabase(ctx)
+		}
+	}
+
+	return Followee{}, ErrNotFollowing
+}
+
+// AcceptFollowing marks the follow request identified by activityID as
+// accepted by the remote actor.
+func AcceptFollowing(ctx context.Context, activityID, actorID string) error {
+	ctx, end := startOp(ctx, "accept_following")
+	defer end()
+	defer lock(ctx)()
+
+	for userID, following := range db.Following {
+		for i, existing := range following {
+			if existing.ActivityID == activityID && existing.ActorID == actorID {
+				following[i].Accepted = true
+				db.Following[userID] = following
+				return saveDatabase(ctx)
+			}
+		}
+	}
+
+	return ErrNotFollowing
+}
+
+// GetLocalFollowersOf returns the IDs of local users with an accepted
+// follow of the remote actor.
+func GetLocalFollowersOf(ctx context.Context, actorID string) ([]int, error) {
+	ctx, end := startOp(ctx, "get_local_followers_of")
+	defer end()
+	defer rlock(ctx)()
+
+	userIDs := make([]int, 0)
+	for userID, following := range db.Following {
+		for _, existing := range following {
+			if existing.ActorID == actorID && existing.Accepted {
+				userIDs = append(userIDs, userID)
+				break
+			}
+		}
+	}
+	sort.Ints(userIDs)
+
+	return userIDs, nil
+}
+
+func AddLike(ctx context.Context, chirpID int, actorID string) error {
+	ctx, end := startOp(ctx, "add_like")
+	defer end()
+	defer lock(ctx)()
+
+	if _, ok := db.Chirps[chirpID]; !ok {
+		return ErrChirpNotFound
+	}
+
+	for _, existing := range db.Likes[chirpID] {
+		if existing == actorID {
+			return nil
+		}
+	}
+
+	db.Likes[chirpID] = append(db.Likes[chirpID], actorID)
+
+	return saveDatabase(ctx)
+}
+
+func RemoveLike(ctx context.Context, chirpID int, actorID string) error {
+	ctx, end := startOp(ctx, "remove_like")
+	defer end()
+	defer lock(ctx)()
+
+	likes := db.Likes[chirpID]
+	for i, existing := range likes {
+		if existing == actorID {
+			db.Likes[chirpID] = append(likes[:i], likes[i+1:]...)
+			return saveDatabase(ctx)
+		}
+	}
+
+	return nil
+}
+
+func CountLikes(ctx context.Context, chirpID int) (int, error) {
+	ctx, end := startOp(ctx, "count_likes")
+	defer end()
+	defer rlock(ctx)()
+
+	return len(db.Likes[chirpID]), nil
+}
+
+// SaveRemoteNote stores a note delivered to local users, merging recipients
+// if the note was already received.
+func SaveRemoteNote(ctx context.Context, note RemoteNote) error {
+	ctx, end := startOp(ctx, "save_remote_note")
+	defer end()
+	defer lock(ctx)()
+
+	if existing, ok := db.RemoteNotes[note.ID]; ok {
+		for _, userID := range existing.Recipients {
+			if !containsInt(note.Recipients, userID) {
+				note.Recipients = append(note.Recipients, userID)
+			}
+		}
+	}
+
+	db.RemoteNotes[note.ID] = note
+
+	return saveDatabase(ctx)
+}
+
+// GetRemoteNotesForUser returns the notes delivered to a local user, newest
+// first.
+func GetRemoteNotesForUser(ctx context.Context, userID int) ([]RemoteNote, error) {
+	ctx, end := startOp(ctx, "get_remote_notes_for_user")
+	defer end()
+	defer rlock(ctx)()
+
+	notes := make([]RemoteNote, 0)
+	for _, note := range db.RemoteNotes {
+		if containsInt(note.Recipients, userID) {
+			notes = append(notes, note)
+		}
+	}
+	sort.Slice(notes, func(i, j int) bool {
+		return notes[i].Published.After(notes[j].Published)
+	})
+
+	return notes, nil
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
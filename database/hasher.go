@@ -0,0 +1,205 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hasher hashes passwords with one algorithm and set of parameters. Hashes
+// carry their own parameters, so any hash an algorithm recognizes can be
+// verified whatever the hasher's settings.
+type Hasher interface {
+	// Algorithm names the algorithm, for traces.
+	Algorithm() string
+	Hash(password string) (string, error)
+	// Recognizes reports whether hash was made by this algorithm.
+	Recognizes(hash string) bool
+	Verify(hash, password string) (bool, error)
+	// Current reports whether hash was made with exactly this hasher's
+	// parameters.
+	Current(hash string) bool
+}
+
+// algorithms are used to verify hashes regardless of the current hasher.
+var algorithms = []Hasher{BcryptHasher{}, Argon2idHasher{}}
+
+var hasher Hasher = BcryptHasher{Cost: bcrypt.DefaultCost}
+
+// SetHasher sets how new passwords are hashed. Existing hashes made any
+// other way are replaced the next time their user logs in.
+func SetHasher(h Hasher) {
+	hasher = h
+}
+
+// HashPassword hashes a password with the current hasher.
+func HashPassword(ctx context.Context, password string) (string, error) {
+	_, span := tracer.Start(ctx, "password.hash", trace.WithAttributes(attribute.String("password.algorithm", hasher.Algorithm())))
+	defer span.End()
+
+	return hasher.Hash(password)
+}
+
+// VerifyPassword reports whether password matches hash, whichever supported
+// algorithm made it.
+func VerifyPassword(ctx context.Context, hash, password string) (bool, error) {
+	for _, h := range algorithms {
+		if h.Recognizes(hash) {
+			_, span := tracer.Start(ctx, "password.verify", trace.WithAttributes(attribute.String("password.algorithm", h.Algorithm())))
+			defer span.End()
+
+			return h.Verify(hash, password)
+		}
+	}
+	return false, errors.New("unrecognized password hash")
+}
+
+// NeedsRehash reports whether hash was made by another algorithm or with
+// other parameters than the current hasher.
+func NeedsRehash(hash string) bool {
+	return !hasher.Recognizes(hash) || !hasher.Current(hash)
+}
+
+// RehashPassword replaces a user's password hash with one from the current
+// hasher. password must already have been verified against oldHash; if the
+// user's hash has changed since, it is left alone.
+func RehashPassword(ctx context.Context, userID int, oldHash, password string) error {
+	ctx, end := startOp(ctx, "rehash_password")
+	defer end()
+
+	// Hashing is slow, so do it before taking the lock.
+	newHash, err := HashPassword(ctx, password)
+	if err != nil {
+		return err
+	}
+
+	defer lock(ctx)()
+
+	user, ok := db.Users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if user.Password != oldHash {
+		return nil
+	}
+
+	user.Password = newHash
+	db.Users[userID] = user
+
+	return saveDatabase(ctx)
+}
+
+// BcryptHasher hashes passwords with bcrypt.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Algorithm() string { return "bcrypt" }
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hash), err
+}
+
+func (h BcryptHasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (h BcryptHasher) Verify(hash, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h BcryptHasher) Current(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost == h.Cost
+}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// Argon2idHasher hashes passwords with Argon2id, stored in the PHC string
+// format: $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>.
+type Argon2idHasher struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+}
+
+func (h Argon2idHasher) Algorithm() string { return "argon2id" }
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h Argon2idHasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (h Argon2idHasher) Verify(hash, password string) (bool, error) {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	got := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(got, key) == 1, nil
+}
+
+func (h Argon2idHasher) Current(hash string) bool {
+	params, _, key, err := parseArgon2id(hash)
+	return err == nil && params == h && len(key) == argon2KeyLength
+}
+
+func parseArgon2id(hash string) (params Argon2idHasher, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, errors.New("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, errors.New("malformed argon2id parameters")
+	}
+	if params.Iterations == 0 || params.Parallelism == 0 {
+		return params, nil, nil, errors.New("malformed argon2id parameters")
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errors.New("malformed argon2id salt")
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errors.New("malformed argon2id key")
+	}
+
+	return params, salt, key, nil
+}
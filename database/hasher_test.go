@@ -0,0 +1,114 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testArgon2id = Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1}
+
+func mustHash(t *testing.T, h Hasher, password string) string {
+	t.Helper()
+	hash, err := h.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestVerifyPassword(t *testing.T) {
+	ctx := context.Background()
+	bcryptHash := mustHash(t, BcryptHasher{Cost: bcrypt.MinCost}, "blue sky meth lab")
+	argonHash := mustHash(t, testArgon2id, "blue sky meth lab")
+
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		ok       bool
+		err      bool
+	}{
+		{"bcrypt", bcryptHash, "blue sky meth lab", true, false},
+		{"bcrypt wrong password", bcryptHash, "say my name", false, false},
+		{"argon2id", argonHash, "blue sky meth lab", true, false},
+		{"argon2id wrong password", argonHash, "say my name", false, false},
+		{"unrecognized", "plaintext", "plaintext", false, true},
+		{"malformed argon2id", "$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5", "blue sky meth lab", false, true},
+		{"wrong argon2 version", "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5", "blue sky meth lab", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := VerifyPassword(ctx, tt.hash, tt.password)
+			if ok != tt.ok || (err != nil) != tt.err {
+				t.Errorf("VerifyPassword = %v, %v; want %v, error %v", ok, err, tt.ok, tt.err)
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	bcrypt4 := mustHash(t, BcryptHasher{Cost: 4}, "blue sky meth lab")
+	bcrypt5 := mustHash(t, BcryptHasher{Cost: 5}, "blue sky meth lab")
+	argon := mustHash(t, testArgon2id, "blue sky meth lab")
+	stronger := mustHash(t, Argon2idHasher{Memory: 128, Iterations: 1, Parallelism: 1}, "blue sky meth lab")
+
+	tests := []struct {
+		name    string
+		current Hasher
+		hash    string
+		rehash  bool
+	}{
+		{"same bcrypt cost", BcryptHasher{Cost: 4}, bcrypt4, false},
+		{"other bcrypt cost", BcryptHasher{Cost: 4}, bcrypt5, true},
+		{"bcrypt to argon2id", testArgon2id, bcrypt4, true},
+		{"same argon2id parameters", testArgon2id, argon, false},
+		{"other argon2id parameters", testArgon2id, stronger, true},
+		{"argon2id to bcrypt", BcryptHasher{Cost: 4}, argon, true},
+	}
+	defer SetHasher(hasher)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetHasher(tt.current)
+			if got := NeedsRehash(tt.hash); got != tt.rehash {
+				t.Errorf("NeedsRehash = %v, want %v", got, tt.rehash)
+			}
+		})
+	}
+}
+
+func TestRehashPassword(t *testing.T) {
+	ctx := context.Background()
+	user := newTestUser(t)
+
+	defer SetHasher(hasher)
+	SetHasher(testArgon2id)
+
+	// A stale old hash means the password changed meanwhile; keep it.
+	if err := RehashPassword(ctx, user.ID, "stale", "blue sky meth lab"); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := GetUserByID(ctx, user.ID); after.Password != user.Password {
+		t.Error("rehash replaced a hash that had changed")
+	}
+
+	if err := RehashPassword(ctx, user.ID, user.Password, "blue sky meth lab"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NeedsRehash(after.Password) {
+		t.Errorf("hash %q was not made by the current hasher", after.Password)
+	}
+	if ok, err := VerifyPassword(ctx, after.Password, "blue sky meth lab"); !ok || err != nil {
+		t.Errorf("rehashed password does not verify: %v", err)
+	}
+
+	if err := RehashPassword(ctx, -1, "", "blue sky meth lab"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("unknown user: got %v, want ErrUserNotFound", err)
+	}
+}
@@ -0,0 +1,33 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Loaded reports whether the database has been loaded and not yet closed.
+func Loaded() bool {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	return db != nil && !closed
+}
+
+// CheckWritable writes and removes a small file next to the database to
+// make sure saves will succeed, catching full disks and bad permissions.
+func CheckWritable() error {
+	f, err := os.CreateTemp(filepath.Dir(databasePath), ".chirpy-write-check-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write([]byte("ok"))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// CreatePasswordReset stores a password reset for a user under the hash of
+// its token. Any earlier reset for the user stops working, and expired
+// resets are discarded.
+func CreatePasswordReset(ctx context.Context, userID int, tokenHash string, expiresIn time.Duration) error {
+	ctx, end := startOp(ctx, "create_password_reset")
+	defer end()
+	defer lock(ctx)()
+
+	if _, ok := db.Users[userID]; !ok {
+		return ErrUserNotFound
+	}
+
+	now := time.Now()
+	for hash, reset := range db.PasswordResets {
+		if reset.UserID == userID || now.After(reset.ExpiresAt) {
+			delete(db.PasswordResets, hash)
+		}
+	}
+
+	db.PasswordResets[tokenHash] = PasswordReset{
+		UserID:    userID,
+		ExpiresAt: now.Add(expiresIn),
+	}
+
+	return saveDatabase(ctx)
+}
+
+// ResetPassword consumes a password reset, sets the user's new password and
+// ends all of their sessions, access tokens included.
+func ResetPassword(ctx context.Context, tokenHash, password string) (User, error) {
+	ctx, end := startOp(ctx, "reset_password")
+	defer end()
+	defer lock(ctx)()
+
+	reset, ok := db.PasswordResets[tokenHash]
+	if !ok || time.Now().After(reset.ExpiresAt) {
+		return User{}, ErrResetTokenInvalid
+	}
+	user, ok := db.Users[reset.UserID]
+	if !ok {
+		return User{}, ErrResetTokenInvalid
+	}
+
+	if err := CheckPassword(password, user.Email); err != nil {
+		return User{}, err
+	}
+
+	hashedPassword, err := HashPassword(ctx, password)
+	if err != nil {
+		return User{}, err
+	}
+	user.Password = hashedPassword
+	db.Users[user.ID] = user
+	delete(db.PasswordResets, tokenHash)
+
+	endAllSessions(user.ID)
+
+	err = saveDatabase(ctx)
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
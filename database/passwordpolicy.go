@@ -0,0 +1,97 @@
+package database
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// bcryptMaxBytes is the most bcrypt hashes; longer passwords are refused
+// rather than silently truncated.
+const bcryptMaxBytes = 72
+
+//go:embed common-passwords.txt
+var commonPasswordList string
+
+var commonPasswords = sync.OnceValue(func() map[string]bool {
+	passwords := make(map[string]bool)
+	for _, line := range strings.Split(commonPasswordList, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			passwords[strings.ToLower(line)] = true
+		}
+	}
+	return passwords
+})
+
+// PasswordPolicy is what new passwords are checked against.
+type PasswordPolicy struct {
+	// MinLength is the fewest characters a password may have.
+	MinLength int
+	// RejectCommon refuses passwords on the bundled list of common and
+	// breached passwords.
+	RejectCommon bool
+}
+
+var passwordPolicy = PasswordPolicy{MinLength: 8, RejectCommon: true}
+
+// SetPasswordPolicy sets the policy CreateUser, UpdateUser and ResetPassword
+// enforce.
+func SetPasswordPolicy(policy PasswordPolicy) {
+	passwordPolicy = policy
+}
+
+// PasswordViolation is one rule a password broke.
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a password broke.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// CheckPassword checks a new password against the policy for a user with the
+// given email addresses. It returns a *PasswordPolicyError if any rule is
+// broken.
+func CheckPassword(password string, emails ...string) error {
+	var violations []PasswordViolation
+	add := func(rule, format string, args ...interface{}) {
+		violations = append(violations, PasswordViolation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if utf8.RuneCountInString(password) < passwordPolicy.MinLength {
+		add("min_length", "Password must be at least %d characters", passwordPolicy.MinLength)
+	}
+	if len(password) > bcryptMaxBytes {
+		add("max_bytes", "Password must be at most %d bytes", bcryptMaxBytes)
+	}
+
+	lowered := strings.ToLower(password)
+	for _, email := range emails {
+		local, _, _ := strings.Cut(emailKey(email), "@")
+		if email != "" && (lowered == emailKey(email) || lowered == local) {
+			add("not_email", "Password must not be your email address")
+			break
+		}
+	}
+	if passwordPolicy.RejectCommon && commonPasswords()[lowered] {
+		add("not_common", "Password is too common and appears in breached password lists")
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
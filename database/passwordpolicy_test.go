@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   PasswordPolicy
+		password string
+		emails   []string
+		rules    []string
+	}{
+		{"acceptable", PasswordPolicy{MinLength: 8, RejectCommon: true}, "blue sky meth lab", nil, nil},
+		{"too short", PasswordPolicy{MinLength: 8}, "hunter2", nil, []string{"min_length"}},
+		{"length counts characters", PasswordPolicy{MinLength: 8}, "ééééééé", nil, []string{"min_length"}},
+		{"too long for bcrypt", PasswordPolicy{MinLength: 8}, strings.Repeat("a", 73), nil, []string{"max_bytes"}},
+		{"common", PasswordPolicy{MinLength: 8, RejectCommon: true}, "Password", nil, []string{"not_common"}},
+		{"common allowed", PasswordPolicy{MinLength: 8}, "password", nil, nil},
+		{"email address", PasswordPolicy{MinLength: 8}, "Walter.White@example.com", []string{"walter.white@example.com"}, []string{"not_email"}},
+		{"email local part", PasswordPolicy{MinLength: 8}, "walter.white", []string{"Walter.White@example.com"}, []string{"not_email"}},
+		{"any of the emails", PasswordPolicy{MinLength: 8}, "heisenberg", []string{"walt@example.com", "heisenberg@example.com"}, []string{"not_email"}},
+		{"every violation", PasswordPolicy{MinLength: 12, RejectCommon: true}, "qwerty", []string{"qwerty@example.com"}, []string{"min_length", "not_email", "not_common"}},
+	}
+	defer SetPasswordPolicy(passwordPolicy)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetPasswordPolicy(tt.policy)
+
+			err := CheckPassword(tt.password, tt.emails...)
+			if tt.rules == nil {
+				if err != nil {
+					t.Errorf("CheckPassword: %v", err)
+				}
+				return
+			}
+			var policyErr *PasswordPolicyError
+			if !errors.As(err, &policyErr) {
+				t.Fatalf("got %v, want a PasswordPolicyError", err)
+			}
+			var rules []string
+			for _, v := range policyErr.Violations {
+				rules = append(rules, v.Rule)
+			}
+			if !reflect.DeepEqual(rules, tt.rules) {
+				t.Errorf("violated %v, want %v", rules, tt.rules)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyEnforced(t *testing.T) {
+	ctx := context.Background()
+	user := newTestUser(t)
+
+	var policyErr *PasswordPolicyError
+	if _, err := CreateUser(ctx, "weak@example.com", "123456"); !errors.As(err, &policyErr) {
+		t.Errorf("CreateUser with a weak password: got %v", err)
+	}
+	if _, err := UpdateUser(ctx, user.ID, user.Email, "letmein"); !errors.As(err, &policyErr) {
+		t.Errorf("UpdateUser with a weak password: got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// SessionClient describes the device a session was last used from.
+type SessionClient struct {
+	UserAgent string
+	IP        string
+}
+
+// Session is a refresh token family as shown to its user. ID is the family
+// ID, which can't be used to refresh.
+type Session struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+}
+
+// ListSessions returns a user's unexpired sessions, most recently used
+// first.
+func ListSessions(ctx context.Context, userID int) ([]Session, error) {
+	ctx, end := startOp(ctx, "list_sessions")
+	defer end()
+	defer rlock(ctx)()
+
+	now := time.Now()
+	sessions := []Session{}
+	for _, token := range db.RefreshTokens {
+		// Only the latest token in a family is unused.
+		if token.UserID != userID || token.RotatedAt != nil || now.After(token.ExpiresAt) {
+			continue
+		}
+		sessions = append(sessions, Session{
+			ID:         token.FamilyID,
+			CreatedAt:  token.CreatedAt,
+			LastUsedAt: token.LastUsedAt,
+			ExpiresAt:  token.ExpiresAt,
+			UserAgent:  token.UserAgent,
+			IP:         token.IP,
+		})
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions, nil
+}
+
+// DeleteSession revokes one of a user's sessions. Access tokens already
+// issued to it stay valid until they expire.
+func DeleteSession(ctx context.Context, userID int, sessionID string) error {
+	ctx, end := startOp(ctx, "delete_session")
+	defer end()
+	defer lock(ctx)()
+
+	found := false
+	for _, token := range db.RefreshTokens {
+		if token.UserID == userID && token.FamilyID == sessionID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrSessionNotFound
+	}
+
+	deleteRefreshTokenFamily(sessionID)
+
+	return saveDatabase(ctx)
+}
+
+// EndAllSessions logs a user out everywhere: every refresh token is revoked
+// and the user's token version is incremented, so access tokens issued
+// before are rejected too. It returns how many sessions were ended.
+func EndAllSessions(ctx context.Context, userID int) (int, error) {
+	ctx, end := startOp(ctx, "end_all_sessions")
+	defer end()
+	defer lock(ctx)()
+
+	if _, ok := db.Users[userID]; !ok {
+		return 0, ErrUserNotFound
+	}
+
+	ended := endAllSessions(userID)
+
+	return ended, saveDatabase(ctx)
+}
+
+func endAllSessions(userID int) int {
+	families := make(map[string]bool)
+	for hash, token := range db.RefreshTokens {
+		if token.UserID == userID {
+			families[token.FamilyID] = true
+			delete(db.RefreshTokens, hash)
+		}
+	}
+
+	if user, ok := db.Users[userID]; ok {
+		user.TokenVersion++
+		db.Users[userID] = user
+	}
+	return len(families)
+}
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestListSessions(t *testing.T) {
+	ctx := context.Background()
+	user := newTestUser(t)
+	other := newTestUser(t)
+
+	laptop, _, err := CreateRefreshToken(ctx, user.ID, time.Hour, SessionClient{UserAgent: "laptop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CreateRefreshToken(ctx, user.ID, -time.Minute, SessionClient{UserAgent: "expired"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CreateRefreshToken(ctx, other.ID, time.Hour, SessionClient{UserAgent: "someone else"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	_, phone, err := CreateRefreshToken(ctx, user.ID, time.Hour, SessionClient{UserAgent: "phone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotating keeps the session, now the most recently used.
+	time.Sleep(time.Millisecond)
+	if _, _, err := RotateRefreshToken(ctx, laptop, SessionClient{UserAgent: "laptop"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := ListSessions(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var agents []string
+	for _, s := range sessions {
+		agents = append(agents, s.UserAgent)
+	}
+	if len(agents) != 2 || agents[0] != "laptop" || agents[1] != "phone" {
+		t.Fatalf("sessions = %v, want [laptop phone]", agents)
+	}
+	if sessions[1].ID != phone.FamilyID {
+		t.Errorf("session ID = %q, want the family ID %q", sessions[1].ID, phone.FamilyID)
+	}
+}
+
+func TestDeleteSession(t *testing.T) {
+	ctx := context.Background()
+	user := newTestUser(t)
+	other := newTestUser(t)
+
+	token, session, err := CreateRefreshToken(ctx, user.ID, time.Hour, SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _, err := RotateRefreshToken(ctx, token, SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, _, err := CreateRefreshToken(ctx, user.ID, time.Hour, SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		userID    int
+		sessionID string
+		err       error
+	}{
+		{"another user's session", other.ID, session.FamilyID, ErrSessionNotFound},
+		{"unknown session", user.ID, "no-such-session", ErrSessionNotFound},
+		{"own session", user.ID, session.FamilyID, nil},
+		{"already deleted", user.ID, session.FamilyID, ErrSessionNotFound},
+	}
+	for _, tt := range tests {
+		if err := DeleteSession(ctx, tt.userID, tt.sessionID); !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	if _, _, err := RotateRefreshToken(ctx, current, SessionClient{}); !errors.Is(err, ErrRefreshTokenNotFound) {
+		t.Errorf("deleted session can still refresh: %v", err)
+	}
+	if _, _, err := RotateRefreshToken(ctx, kept, SessionClient{}); err != nil {
+		t.Errorf("other session was deleted too: %v", err)
+	}
+}
+
+func TestEndAllSessions(t *testing.T) {
+	ctx := context.Background()
+	user := newTestUser(t)
+	other := newTestUser(t)
+
+	var tokens []string
+	for i := 0; i < 2; i++ {
+		token, _, err := CreateRefreshToken(ctx, user.ID, time.Hour, SessionClient{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+	// A rotated family still counts once.
+	rotated, _, err := RotateRefreshToken(ctx, tokens[1], SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens = append(tokens, rotated)
+	otherToken, _, err := CreateRefreshToken(ctx, other.ID, time.Hour, SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ended, err := EndAllSessions(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ended != 2 {
+		t.Errorf("ended %d sessions, want 2", ended)
+	}
+
+	for _, token := range tokens {
+		if _, _, err := RotateRefreshToken(ctx, token, SessionClient{}); !errors.Is(err, ErrRefreshTokenNotFound) {
+			t.Errorf("token survived: %v", err)
+		}
+	}
+	if _, _, err := RotateRefreshToken(ctx, otherToken, SessionClient{}); err != nil {
+		t.Errorf("another user's session was ended: %v", err)
+	}
+
+	// Bumping the token version is what rejects access tokens issued
+	// before.
+	after, err := GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.TokenVersion != user.TokenVersion+1 {
+		t.Errorf("TokenVersion = %d, want %d", after.TokenVersion, user.TokenVersion+1)
+	}
+
+	if _, err := EndAllSessions(ctx, -1); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("unknown user: got %v, want ErrUserNotFound", err)
+	}
+}
@@ -0,0 +1,43 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/Delvoid/chirpy/database")
+
+// startOp starts a span for a store operation. The returned function ends
+// the span and reports the operation's duration to the observer.
+func startOp(ctx context.Context, op string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "database."+op, trace.WithAttributes(attribute.String("db.operation", op)))
+
+	return ctx, func() {
+		span.End()
+		if observer != nil {
+			observer(op, time.Since(start))
+		}
+	}
+}
+
+// lock takes dbMutex for writing and returns the matching unlock. Time spent
+// waiting for other requests is recorded as its own span.
+func lock(ctx context.Context) func() {
+	_, span := tracer.Start(ctx, "database.lock_wait", trace.WithAttributes(attribute.String("lock.mode", "write")))
+	dbMutex.Lock()
+	span.End()
+	return dbMutex.Unlock
+}
+
+// rlock is lock for readers.
+func rlock(ctx context.Context) func() {
+	_, span := tracer.Start(ctx, "database.lock_wait", trace.WithAttributes(attribute.String("lock.mode", "read")))
+	dbMutex.RLock()
+	span.End()
+	return dbMutex.RUnlock
+}
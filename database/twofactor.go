@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// SetPendingTOTP stores a new encrypted TOTP secret for a user without
+// enabling it, replacing any earlier unfinished enrollment.
+func SetPendingTOTP(ctx context.Context, userID int, encryptedSecret string) error {
+	ctx, end := startOp(ctx, "set_pending_totp")
+	defer end()
+	defer lock(ctx)()
+
+	user, ok := db.Users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	user.TOTPSecret = encryptedSecret
+	user.TOTPEnabled = false
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+	db.Users[userID] = user
+
+	return saveDatabase(ctx)
+}
+
+// ResealTOTPSecrets passes every stored TOTP secret through reseal and
+// saves the ones it changed, returning how many there were. Secrets reseal
+// fails on are left as they are and reported in the error.
+func ResealTOTPSecrets(ctx context.Context, reseal func(sealed string) (string, error)) (int, error) {
+	ctx, end := startOp(ctx, "reseal_totp_secrets")
+	defer end()
+	defer lock(ctx)()
+
+	var errs []error
+	changed := 0
+	for id, user := range db.Users {
+		if user.TOTPSecret == "" {
+			continue
+		}
+		sealed, err := reseal(user.TOTPSecret)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("user %d: %w", id, err))
+			continue
+		}
+		if sealed != user.TOTPSecret {
+			user.TOTPSecret = sealed
+			db.Users[id] = user
+			changed++
+		}
+	}
+
+	if changed > 0 {
+		if err := saveDatabase(ctx); err != nil {
+			return 0, err
+		}
+	}
+	return changed, errors.Join(errs...)
+}
+
+// EnableTOTP turns on two-factor authentication for a user with a pending
+// secret. step is the time step of the code that confirmed enrollment, and
+// recoveryCodes are the hashes of the user's new recovery codes.
+func EnableTOTP(ctx context.Context, userID int, step int64, recoveryCodes []string) error {
+	ctx, end := startOp(ctx, "enable_totp")
+	defer end()
+	defer lock(ctx)()
+
+	user, ok := db.Users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if user.TOTPSecret == "" || user.TOTPEnabled {
+		return ErrTOTPNotPending
+	}
+
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	user.RecoveryCodes = recoveryCodes
+	db.Users[userID] = user
+
+	return saveDatabase(ctx)
+}
+
+// UseTOTPStep records that the code for a time step has been used, so the
+// same code can't be replayed. Steps at or before the last used one fail
+// with ErrTOTPCodeReused.
+func UseTOTPStep(ctx context.Context, userID int, step int64) error {
+	ctx, end := startOp(ctx, "use_totp_step")
+	defer end()
+	defer lock(ctx)()
+
+	user, ok := db.Users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if step <= user.TOTPLastStep {
+		return ErrTOTPCodeReused
+	}
+
+	user.TOTPLastStep = step
+	db.Users[userID] = user
+
+	return saveDatabase(ctx)
+}
+
+// UseRecoveryCode consumes one of a user's recovery codes, identified by its
+// hash.
+func UseRecoveryCode(ctx context.Context, userID int, codeHash string) error {
+	ctx, end := startOp(ctx, "use_recovery_code")
+	defer end()
+	defer lock(ctx)()
+
+	user, ok := db.Users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	for i, hash := range user.RecoveryCodes {
+		if hash == codeHash {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			db.Users[userID] = user
+			return saveDatabase(ctx)
+		}
+	}
+
+	return ErrRecoveryCodeInvalid
+}
@@ -8,12 +8,29 @@ var (
 	ErrChirpNotFound = errors.New("chirp not found")
 	ErrUserNotFound  = errors.New("user not found")
 	ErrUserExists    = errors.New("user already exists")
+	ErrNotFollowing  = errors.New("not following")
+	ErrInvalidRole   = errors.New("invalid role")
+	ErrInvalidEmail  = errors.New("invalid email address")
+
+	ErrTOTPNotPending      = errors.New("two-factor setup has not been started")
+	ErrTOTPCodeReused      = errors.New("two-factor code has already been used")
+	ErrRecoveryCodeInvalid = errors.New("invalid recovery code")
+
+	ErrRefreshTokenNotFound     = errors.New("refresh token not found")
+	ErrRefreshTokenReused       = errors.New("refresh token has already been used")
+	ErrSessionNotFound          = errors.New("session not found")
+	ErrResetTokenInvalid        = errors.New("invalid or expired password reset token")
+	ErrVerificationTokenInvalid = errors.New("invalid or expired email verification token")
+	ErrEmailNotVerified         = errors.New("email address has not been verified")
+
+	ErrDatabaseClosed = errors.New("database is closed")
 )
 
 type Chirp struct {
-	ID       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorID int    `json:"author_id"`
+	ID        int       `json:"id"`
+	Body      string    `json:"body"`
+	AuthorID  int       `json:"author_id"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type Database struct {
@@ -22,6 +39,18 @@ type Database struct {
 	NextID        int                     `json:"next_id"`
 	NextUserID    int                     `json:"next_user_id"`
 	RefreshTokens map[string]RefreshToken `json:"refresh_tokens"`
+	ActorKeys     map[int]string          `json:"actor_keys,omitempty"`
+	Followers     map[int][]Follower      `json:"followers,omitempty"`
+	Following     map[int][]Followee      `json:"following,omitempty"`
+	Likes         map[int][]string        `json:"likes,omitempty"`
+	RemoteNotes   map[string]RemoteNote   `json:"remote_notes,omitempty"`
+
+	// PasswordResets is keyed by the SHA-256 hash of the mailed token, so a
+	// leaked database file can't be used to take over accounts.
+	PasswordResets map[string]PasswordReset `json:"password_resets,omitempty"`
+
+	// EmailVerifications is keyed by token hash like PasswordResets.
+	EmailVerifications map[string]EmailVerification `json:"email_verifications,omitempty"`
 }
 
 type User struct {
@@ -29,10 +58,109 @@ type User struct {
 	Email       string `json:"email"`
 	Password    string `json:"password"`
 	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Role        Role   `json:"role"`
+
+	// Verified is set once the user has confirmed they receive mail at
+	// Email. A new address waits in PendingEmail until it is confirmed.
+	Verified     bool   `json:"verified"`
+	PendingEmail string `json:"pending_email,omitempty"`
+
+	// TOTPSecret is the encrypted authenticator secret. It is only in use
+	// once TOTPEnabled is set; until then it is a pending enrollment.
+	TOTPSecret    string   `json:"totp_secret,omitempty"`
+	TOTPEnabled   bool     `json:"totp_enabled,omitempty"`
+	TOTPLastStep  int64    `json:"totp_last_step,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+
+	// TokenVersion is embedded in access tokens; incrementing it rejects
+	// every access token issued before.
+	TokenVersion int `json:"token_version,omitempty"`
+}
+
+// Role controls what a user may do beyond managing their own account.
+// Each role includes the permissions of the ones before it.
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// ParseRole validates a role name.
+func ParseRole(name string) (Role, error) {
+	role := Role(name)
+	if _, ok := roleRanks[role]; !ok {
+		return "", ErrInvalidRole
+	}
+	return role, nil
 }
 
+// Includes reports whether r grants at least the permissions of other.
+func (r Role) Includes(other Role) bool {
+	return roleRanks[r] >= roleRanks[other]
+}
+
+// RefreshToken is stored under the SHA-256 hash of the token handed to the
+// client. Each refresh rotates it: the token is marked as used and a new
+// one is issued in the same family. Presenting a used token again means it
+// was stolen, so the whole family is revoked.
+//
+// A family is one signed-in session. CreatedAt is when it started and is
+// carried over on rotation; LastUsedAt, UserAgent and IP describe the
+// request that issued this token.
 type RefreshToken struct {
-	Token     string    `json:"token"`
+	TokenHash  string     `json:"token_hash"`
+	UserID     int        `json:"user_id"`
+	FamilyID   string     `json:"family_id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	UserAgent  string     `json:"user_agent,omitempty"`
+	IP         string     `json:"ip,omitempty"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+}
+
+// PasswordReset lets the holder of its token set a new password for a user
+// once, until it expires.
+type PasswordReset struct {
+	UserID    int       `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// EmailVerification confirms that a user receives mail at Email.
+type EmailVerification struct {
 	UserID    int       `json:"user_id"`
+	Email     string    `json:"email"`
 	ExpiresAt time.Time `json:"expires_at"`
 }
+
+// Follower is a remote ActivityPub actor following a local user.
+type Follower struct {
+	ActorID string `json:"actor_id"`
+	Inbox   string `json:"inbox"`
+}
+
+// Followee is a remote ActivityPub actor a local user follows.
+type Followee struct {
+	ActorID    string `json:"actor_id"`
+	Inbox      string `json:"inbox"`
+	ActivityID string `json:"activity_id"`
+	Accepted   bool   `json:"accepted"`
+}
+
+// RemoteNote is a post delivered to a local user's inbox by a remote actor.
+type RemoteNote struct {
+	ID           string    `json:"id"`
+	AttributedTo string    `json:"attributed_to"`
+	Content      string    `json:"content"`
+	URL          string    `json:"url,omitempty"`
+	Published    time.Time `json:"published"`
+	Recipients   []int     `json:"recipients"`
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Delvoid/chirpy/database"
+)
+
+// emailVerifier mails verification tokens for new and changed addresses.
+type emailVerifier struct {
+	mailer Mailer
+	ttl    time.Duration
+	url    string
+}
+
+// send mails a verification token for email, which is either the user's
+// current address or their pending one.
+func (v *emailVerifier) send(ctx context.Context, userID int, email string) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	err = database.CreateEmailVerification(ctx, userID, email, hashToken(token), v.ttl)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Please confirm that %s is your email address for Chirpy.\n\n"+
+		"Your verification token is:\n\n    %s\n\n", email, token)
+	if v.url != "" {
+		body += fmt.Sprintf("Or follow this link:\n\n    %s\n\n", v.url+"?token="+url.QueryEscape(token))
+	}
+	body += fmt.Sprintf("It expires in %s. If you didn't sign up or change your email, ignore this email.", v.ttl)
+
+	return v.mailer.Send(ctx, mailMessage{
+		To:      email,
+		Subject: "Confirm your Chirpy email address",
+		Body:    body,
+	})
+}
+
+type verifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+func verifyEmailHandler(bootstrapAdminEmail string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req verifyEmailRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		user, err := database.VerifyEmail(r.Context(), hashToken(req.Token))
+		if err != nil {
+			switch {
+			case errors.Is(err, database.ErrVerificationTokenInvalid):
+				respondWithError(w, "Invalid or expired verification token", http.StatusBadRequest)
+			case errors.Is(err, database.ErrUserExists):
+				respondWithError(w, "Email is already in use", http.StatusConflict)
+			default:
+				respondWithError(w, "Failed to verify email", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if user.Verified && strings.EqualFold(user.Email, bootstrapAdminEmail) {
+			bootstrapAdmin(r.Context(), bootstrapAdminEmail)
+		}
+
+		respondWithJSON(w, userResponse(user), http.StatusOK)
+	}
+}
+
+// resendVerificationHandler mails a fresh token for the user's pending email,
+// or for their current one if it has not been verified.
+func resendVerificationHandler(jwtKeys *keyring, verifier *emailVerifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := validateToken(r, jwtKeys)
+		if err != nil {
+			respondWithError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		user, err := database.GetUserByID(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		email := user.PendingEmail
+		if email == "" {
+			if user.Verified {
+				respondWithError(w, "Email is already verified", http.StatusConflict)
+				return
+			}
+			email = user.Email
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		sendInBackground(r, "email verification", func(ctx context.Context) error {
+			return verifier.send(ctx, user.ID, email)
+		})
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Delvoid/chirpy/database"
+)
+
+// feedSize is the number of most recent chirps included in a feed.
+const feedSize = 50
+
+// serverStarted stands in as the update time of feeds without chirps, since
+// Atom requires one and the zero time would look like a broken feed.
+var serverStarted = time.Now().UTC().Truncate(time.Second)
+
+type feedFormat string
+
+const (
+	feedRSS  feedFormat = "rss"
+	feedAtom feedFormat = "atom"
+	feedJSON feedFormat = "json"
+)
+
+type feed struct {
+	Title   string
+	Link    string
+	SelfURL string
+	Updated time.Time
+	BaseURL string
+	Chirps  []database.Chirp
+}
+
+type rssDocument struct {
+	XMLName   xml.Name   `xml:"rss"`
+	Version   string     `xml:"version,attr"`
+	AtomSpace string     `xml:"xmlns:atom,attr"`
+	Channel   rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string      `xml:"title"`
+	Link          string      `xml:"link"`
+	Description   string      `xml:"description"`
+	AtomLink      rssAtomLink `xml:"atom:link"`
+	LastBuildDate string      `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem   `xml:"item"`
+}
+
+type rssAtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate,omitempty"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published,omitempty"`
+	Link      atomLink    `xml:"link"`
+	Author    atomAuthor  `xml:"author"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url,omitempty"`
+	FeedURL     string         `json:"feed_url"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string           `json:"id"`
+	URL           string           `json:"url"`
+	ContentText   string           `json:"content_text"`
+	DatePublished string           `json:"date_published,omitempty"`
+	Authors       []jsonFeedAuthor `json:"authors"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+}
+
+func userFeedHandler(format feedFormat) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("userID"))
+		if err != nil {
+			respondWithError(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		_, err = database.GetUserByID(r.Context(), userID)
+		if err != nil {
+			if errors.Is(err, database.ErrUserNotFound) {
+				respondWithError(w, "User not found", http.StatusNotFound)
+			} else {
+				respondWithError(w, "Failed to retrieve user", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		chirps, err := database.GetChirpsByAuthorID(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, "Failed to retrieve chirps", http.StatusInternalServerError)
+			return
+		}
+
+		base := baseURL()
+		f := newFeed(chirps, base)
+		f.Title = fmt.Sprintf("Chirps by %s", authorName(userID))
+		f.Link = fmt.Sprintf("%s/api/chirps?author_id=%d", base, userID)
+		f.SelfURL = base + r.URL.Path
+
+		writeFeed(w, r, f, format)
+	}
+}
+
+func globalFeedHandler(format feedFormat) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chirps, err := database.GetChirps(r.Context())
+		if err != nil {
+			respondWithError(w, "Failed to retrieve chirps", http.StatusInternalServerError)
+			return
+		}
+
+		base := baseURL()
+		f := newFeed(chirps, base)
+		f.Title = "Chirpy"
+		f.Link = base + "/api/chirps"
+		f.SelfURL = base + r.URL.Path
+
+		writeFeed(w, r, f, format)
+	}
+}
+
+func newFeed(chirps []database.Chirp, base string) feed {
+	chirps = sortChirps(chirps, "desc")
+	if len(chirps) > feedSize {
+		chirps = chirps[:feedSize]
+	}
+
+	var updated time.Time
+	for _, chirp := range chirps {
+		if chirp.CreatedAt.After(updated) {
+			updated = chirp.CreatedAt
+		}
+	}
+	if updated.IsZero() {
+		updated = serverStarted
+	}
+
+	return feed{
+		Updated: updated,
+		BaseURL: base,
+		Chirps:  chirps,
+	}
+}
+
+func writeFeed(w http.ResponseWriter, r *http.Request, f feed, format feedFormat) {
+	var body []byte
+	var contentType string
+	var err error
+
+	switch format {
+	case feedRSS:
+		body, err = renderRSS(f)
+		contentType = "application/rss+xml; charset=utf-8"
+	case feedAtom:
+		body, err = renderAtom(f)
+		contentType = "application/atom+xml; charset=utf-8"
+	default:
+		body, err = renderJSONFeed(f)
+		contentType = "application/feed+json; charset=utf-8"
+	}
+	if err != nil {
+		log.Printf("Error rendering %s feed: %s", format, err)
+		respondWithError(w, "Failed to render feed", http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	if !f.Updated.IsZero() {
+		w.Header().Set("Last-Modified", f.Updated.UTC().Format(http.TimeFormat))
+	}
+
+	if notModified(r, etag, f.Updated) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// notModified reports whether the client's cached copy is still current.
+// If-None-Match takes precedence over If-Modified-Since as per RFC 9110.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		return !lastModified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+func renderRSS(f feed) ([]byte, error) {
+	doc := rssDocument{
+		Version:   "2.0",
+		AtomSpace: "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:       f.Title,
+			Link:        f.Link,
+			Description: f.Title,
+			AtomLink: rssAtomLink{
+				Href: f.SelfURL,
+				Rel:  "self",
+				Type: "application/rss+xml",
+			},
+			Items: make([]rssItem, 0, len(f.Chirps)),
+		},
+	}
+	if !f.Updated.IsZero() {
+		doc.Channel.LastBuildDate = f.Updated.UTC().Format(time.RFC1123Z)
+	}
+
+	for _, chirp := range f.Chirps {
+		link := chirpPermalink(f.BaseURL, chirp.ID)
+		item := rssItem{
+			Title:       chirp.Body,
+			Link:        link,
+			Description: chirp.Body,
+			GUID:        rssGUID{IsPermaLink: true, Value: link},
+		}
+		if !chirp.CreatedAt.IsZero() {
+			item.PubDate = chirp.CreatedAt.UTC().Format(time.RFC1123Z)
+		}
+		doc.Channel.Items = append(doc.Channel.Items, item)
+	}
+
+	return marshalXML(doc)
+}
+
+func renderAtom(f feed) ([]byte, error) {
+	doc := atomFeed{
+		Title:   f.Title,
+		ID:      f.SelfURL,
+		Updated: atomTime(f.Updated),
+		Links: []atomLink{
+			{Href: f.SelfURL, Rel: "self", Type: "application/atom+xml"},
+			{Href: f.Link, Rel: "alternate", Type: "application/json"},
+		},
+		Entries: make([]atomEntry, 0, len(f.Chirps)),
+	}
+
+	for _, chirp := range f.Chirps {
+		link := chirpPermalink(f.BaseURL, chirp.ID)
+		entry := atomEntry{
+			Title:   chirp.Body,
+			ID:      link,
+			Updated: atomTime(chirp.CreatedAt),
+			Link:    atomLink{Href: link, Rel: "alternate"},
+			Author: atomAuthor{
+				Name: authorName(chirp.AuthorID),
+				URI:  fmt.Sprintf("%s/api/chirps?author_id=%d", f.BaseURL, chirp.AuthorID),
+			},
+			Content: atomContent{Type: "text", Value: chirp.Body},
+		}
+		if !chirp.CreatedAt.IsZero() {
+			entry.Published = atomTime(chirp.CreatedAt)
+		}
+		doc.Entries = append(doc.Entries, entry)
+	}
+
+	return marshalXML(doc)
+}
+
+func renderJSONFeed(f feed) ([]byte, error) {
+	doc := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: f.Link,
+		FeedURL:     f.SelfURL,
+		Items:       make([]jsonFeedItem, 0, len(f.Chirps)),
+	}
+
+	for _, chirp := range f.Chirps {
+		link := chirpPermalink(f.BaseURL, chirp.ID)
+		item := jsonFeedItem{
+			ID:          link,
+			URL:         link,
+			ContentText: chirp.Body,
+			Authors: []jsonFeedAuthor{{
+				Name: authorName(chirp.AuthorID),
+				URL:  fmt.Sprintf("%s/api/chirps?author_id=%d", f.BaseURL, chirp.AuthorID),
+			}},
+		}
+		if !chirp.CreatedAt.IsZero() {
+			item.DatePublished = chirp.CreatedAt.UTC().Format(time.RFC3339)
+		}
+		doc.Items = append(doc.Items, item)
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// atomTime formats t as an RFC 3339 timestamp.
+func atomTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func authorName(userID int) string {
+	return fmt.Sprintf("Chirpy user %d", userID)
+}
+
+func chirpPermalink(base string, chirpID int) string {
+	return fmt.Sprintf("%s/api/chirps/%d", base, chirpID)
+}
+
+// publicURL is the externally visible scheme and host of the server, set
+// from config.baseURL at startup.
+var publicURL = "http://localhost:8080"
+
+// baseURL returns the scheme and host that links in responses point at.
+func baseURL() string {
+	return publicURL
+}
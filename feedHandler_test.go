@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Delvoid/chirpy/database"
+)
+
+func TestNewFeedUpdated(t *testing.T) {
+	older := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	newer := older.Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		chirps []database.Chirp
+		want   time.Time
+	}{
+		{"no chirps", nil, serverStarted},
+		{"latest chirp", []database.Chirp{{ID: 1, CreatedAt: older}, {ID: 2, CreatedAt: newer}}, newer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFeed(tt.chirps, "https://chirpy.example.com")
+			if !f.Updated.Equal(tt.want) {
+				t.Errorf("Updated = %v, want %v", f.Updated, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmptyFeedsHaveUpdateTime(t *testing.T) {
+	f := newFeed(nil, "https://chirpy.example.com")
+	f.Title = "Chirpy"
+
+	atom, err := renderAtom(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(atom), "<updated>"+serverStarted.Format(time.RFC3339)+"</updated>") {
+		t.Errorf("Atom feed lacks the fallback update time:\n%s", atom)
+	}
+
+	rss, err := renderRSS(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(rss), "0001") || !strings.Contains(string(rss), "<lastBuildDate>") {
+		t.Errorf("RSS feed lacks a sensible lastBuildDate:\n%s", rss)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Delvoid/chirpy/database"
+)
+
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// readinessChecks are run by /api/readyz. Each returns nil when the server
+// can rely on that dependency. Older database files are upgraded during
+// loading, before the listener opens, so store_loaded covers migrations.
+var readinessChecks = map[string]func() error{
+	"store_loaded": func() error {
+		if !database.Loaded() {
+			return errors.New("database is not loaded")
+		}
+		return nil
+	},
+	"store_writable": database.CheckWritable,
+}
+
+// livezHandler reports that the process is up and serving requests. It
+// checks nothing else, so a failing dependency doesn't get the server
+// restarted.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, healthResponse{Status: "ok"}, http.StatusOK)
+}
+
+// readyzHandler reports whether the server can handle traffic, with the
+// result of each check.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{
+		Status: "ok",
+		Checks: make(map[string]healthCheck, len(readinessChecks)),
+	}
+	for name, check := range readinessChecks {
+		if err := check(); err != nil {
+			resp.Status = "unavailable"
+			resp.Checks[name] = healthCheck{Status: "fail", Error: err.Error()}
+			continue
+		}
+		resp.Checks[name] = healthCheck{Status: "ok"}
+	}
+
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	respondWithJSON(w, resp, status)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP signatures follow draft-cavage-http-signatures-12 with rsa-sha256,
+// which is what Mastodon and most of the fediverse expect.
+
+// maxSignatureSkew bounds how far the Date header of a signed request may be
+// from the local clock.
+const maxSignatureSkew = time.Hour
+
+// publicKeyTTL is how long fetched remote public keys are cached.
+const publicKeyTTL = time.Hour
+
+// maxCachedKeys bounds the public key cache, since remote servers choose
+// which keys we fetch.
+const maxCachedKeys = 1000
+
+var signedHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+type signatureParams struct {
+	KeyID     string
+	Algorithm string
+	Headers   []string
+	Signature []byte
+}
+
+type cachedKey struct {
+	key       *rsa.PublicKey
+	owner     string
+	fetchedAt time.Time
+}
+
+var (
+	publicKeyCache   = make(map[string]cachedKey)
+	publicKeyCacheMu sync.Mutex
+)
+
+// signRequest adds Digest, Date and Signature headers to r.
+func signRequest(r *http.Request, body []byte, keyID string, key *rsa.PrivateKey) error {
+	digest := sha256.Sum256(body)
+	r.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if r.Host == "" {
+		r.Host = r.URL.Host
+	}
+
+	signingString, err := buildSigningString(r, signedHeaders)
+	if err != nil {
+		return err
+	}
+
+	hashed := sha256.Sum256([]byte(signingString))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(signedHeaders, " "), base64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
+
+// verifyRequest checks the HTTP signature and body digest of an incoming
+// request and returns the actor that owns the signing key.
+func verifyRequest(r *http.Request, body []byte) (string, error) {
+	params, err := parseSignatureHeader(r.Header.Get("Signature"))
+	if err != nil {
+		return "", err
+	}
+
+	for _, required := range signedHeaders {
+		if !containsString(params.Headers, required) {
+			return "", fmt.Errorf("signature does not cover %s", required)
+		}
+	}
+
+	digest := sha256.Sum256(body)
+	if r.Header.Get("Digest") != "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]) {
+		return "", errors.New("digest mismatch")
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return "", errors.New("invalid Date header")
+	}
+	if skew := time.Since(date); skew > maxSignatureSkew || skew < -maxSignatureSkew {
+		return "", errors.New("Date header is too far from the current time")
+	}
+
+	signingString, err := buildSigningString(r, params.Headers)
+	if err != nil {
+		return "", err
+	}
+	hashed := sha256.Sum256([]byte(signingString))
+
+	key, owner, err := fetchPublicKey(r.Context(), params.KeyID, false)
+	if err != nil {
+		return "", err
+	}
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], params.Signature) == nil {
+		return owner, nil
+	}
+
+	// The remote actor may have rotated its key since we cached it.
+	key, owner, err = fetchPublicKey(r.Context(), params.KeyID, true)
+	if err != nil {
+		return "", err
+	}
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], params.Signature); err != nil {
+		return "", errors.New("invalid signature")
+	}
+
+	return owner, nil
+}
+
+func buildSigningString(r *http.Request, headers []string) (string, error) {
+	lines := make([]string, 0, len(headers))
+	for _, header := range headers {
+		switch header {
+		case "(request-target)":
+			lines = append(lines, fmt.Sprintf("(request-target): %s %s", strings.ToLower(r.Method), r.URL.RequestURI()))
+		case "host":
+			lines = append(lines, "host: "+r.Host)
+		default:
+			values := r.Header.Values(header)
+			if len(values) == 0 {
+				return "", fmt.Errorf("missing signed header %s", header)
+			}
+			lines = append(lines, header+": "+strings.Join(values, ", "))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func parseSignatureHeader(header string) (signatureParams, error) {
+	if header == "" {
+		return signatureParams{}, errors.New("missing Signature header")
+	}
+
+	params := signatureParams{Headers: []string{"date"}}
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return signatureParams{}, errors.New("malformed Signature header")
+		}
+		value = strings.Trim(value, `"`)
+
+		switch key {
+		case "keyId":
+			params.KeyID = value
+		case "algorithm":
+			params.Algorithm = value
+		case "headers":
+			params.Headers = strings.Fields(strings.ToLower(value))
+		case "signature":
+			signature, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return signatureParams{}, errors.New("malformed signature")
+			}
+			params.Signature = signature
+		}
+	}
+
+	if params.KeyID == "" || params.Signature == nil {
+		return signatureParams{}, errors.New("malformed Signature header")
+	}
+	if params.Algorithm != "" && params.Algorithm != "rsa-sha256" && params.Algorithm != "hs2019" {
+		return signatureParams{}, fmt.Errorf("unsupported signature algorithm %s", params.Algorithm)
+	}
+
+	return params, nil
+}
+
+// fetchPublicKey resolves a keyId to the RSA public key and owning actor,
+// using a short lived cache unless refresh is set.
+func fetchPublicKey(ctx context.Context, keyID string, refresh bool) (*rsa.PublicKey, string, error) {
+	publicKeyCacheMu.Lock()
+	cached, ok := publicKeyCache[keyID]
+	publicKeyCacheMu.Unlock()
+	if ok && !refresh && time.Since(cached.fetchedAt) < publicKeyTTL {
+		return cached.key, cached.owner, nil
+	}
+
+	// keyIds are usually a fragment of the actor document.
+	keyURL, _, _ := strings.Cut(keyID, "#")
+
+	var doc struct {
+		ID        string `json:"id"`
+		Owner     string `json:"owner"`
+		PublicKey struct {
+			ID           string `json:"id"`
+			Owner        string `json:"owner"`
+			PublicKeyPem string `json:"publicKeyPem"`
+		} `json:"publicKey"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	}
+	if err := fetchActivityJSON(ctx, keyURL, &doc); err != nil {
+		return nil, "", fmt.Errorf("fetching public key: %w", err)
+	}
+
+	keyPem, owner := doc.PublicKey.PublicKeyPem, doc.PublicKey.Owner
+	if doc.PublicKeyPem != "" {
+		keyPem, owner = doc.PublicKeyPem, doc.Owner
+	}
+	if owner == "" {
+		owner = doc.ID
+	}
+
+	key, err := parsePublicKeyPEM(keyPem)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := verifyKeyOwner(ctx, keyID, owner, key); err != nil {
+		return nil, "", err
+	}
+
+	cacheKey(keyID, cachedKey{key: key, owner: owner, fetchedAt: time.Now()})
+
+	return key, owner, nil
+}
+
+// cacheKey stores a verified key. When the cache is full, expired keys are
+// dropped first and then the oldest.
+func cacheKey(keyID string, entry cachedKey) {
+	publicKeyCacheMu.Lock()
+	defer publicKeyCacheMu.Unlock()
+
+	if _, ok := publicKeyCache[keyID]; !ok && len(publicKeyCache) >= maxCachedKeys {
+		oldest := ""
+		for id, cached := range publicKeyCache {
+			if entry.fetchedAt.Sub(cached.fetchedAt) >= publicKeyTTL {
+				delete(publicKeyCache, id)
+			} else if oldest == "" || cached.fetchedAt.Before(publicKeyCache[oldest].fetchedAt) {
+				oldest = id
+			}
+		}
+		if len(publicKeyCache) >= maxCachedKeys {
+			delete(publicKeyCache, oldest)
+		}
+	}
+	publicKeyCache[keyID] = entry
+}
+
+// verifyKeyOwner checks that owner really claims the key: the key must be
+// hosted on the owner's origin, and the owner's actor document must publish
+// the same key under keyID. Without this anyone could sign as any actor by
+// naming it as the owner of their own key.
+func verifyKeyOwner(ctx context.Context, keyID, owner string, key *rsa.PublicKey) error {
+	if !sameOrigin(keyID, owner) {
+		return fmt.Errorf("key %s is not hosted with its owner %s", keyID, owner)
+	}
+
+	var actor struct {
+		ID        string `json:"id"`
+		PublicKey struct {
+			ID           string `json:"id"`
+			PublicKeyPem string `json:"publicKeyPem"`
+		} `json:"publicKey"`
+	}
+	if err := fetchActivityJSON(ctx, owner, &actor); err != nil {
+		return fmt.Errorf("fetching key owner: %w", err)
+	}
+	if actor.ID != owner || actor.PublicKey.ID != keyID {
+		return fmt.Errorf("actor %s does not publish key %s", owner, keyID)
+	}
+
+	published, err := parsePublicKeyPEM(actor.PublicKey.PublicKeyPem)
+	if err != nil {
+		return err
+	}
+	if !published.Equal(key) {
+		return fmt.Errorf("actor %s publishes a different key as %s", owner, keyID)
+	}
+	return nil
+}
+
+// sameOrigin reports whether two URLs share a scheme and host.
+func sameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return ua.Host != "" && strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host)
+}
+
+// fetchActivityJSON GETs an ActivityPub document and decodes it into v.
+func fetchActivityJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", activityContentType)
+
+	resp, err := apClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, maxActivitySize)).Decode(v)
+}
+
+func parsePublicKeyPEM(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("invalid public key PEM")
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not RSA")
+	}
+	return key, nil
+}
+
+func parsePrivateKeyPEM(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("invalid private key PEM")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func encodePublicKeyPEM(key *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// actorServer serves ActivityPub documents from a map, so tests can publish
+// and swap actors' keys.
+type actorServer struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	docs map[string]interface{}
+}
+
+func newActorServer(t *testing.T) *actorServer {
+	s := &actorServer{docs: make(map[string]interface{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		doc, ok := s.docs[r.URL.Path]
+		s.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", activityContentType)
+		json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// publish serves an actor at path whose publicKey is keyID, owned by owner.
+func (s *actorServer) publish(t *testing.T, path, keyID, owner string, key *rsa.PublicKey) {
+	t.Helper()
+	keyPem, err := encodePublicKeyPEM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs[path] = map[string]interface{}{
+		"id":   s.URL + path,
+		"type": "Person",
+		"publicKey": map[string]string{
+			"id":           keyID,
+			"owner":        owner,
+			"publicKeyPem": keyPem,
+		},
+	}
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// useTestFederation lets the ActivityPub client reach httptest servers and
+// starts with an empty key cache.
+func useTestFederation(t *testing.T) {
+	saved := apClient
+	apClient = newAPClient(true)
+	clearKeyCache()
+	t.Cleanup(func() {
+		apClient = saved
+		clearKeyCache()
+	})
+}
+
+func clearKeyCache() {
+	publicKeyCacheMu.Lock()
+	defer publicKeyCacheMu.Unlock()
+	publicKeyCache = make(map[string]cachedKey)
+}
+
+func signedInboxRequest(t *testing.T, body []byte, keyID string, key *rsa.PrivateKey) *http.Request {
+	t.Helper()
+	r, err := http.NewRequest("POST", "https://chirpy.example.com/ap/users/1/inbox", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signRequest(r, body, keyID, key); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestVerifyRequest(t *testing.T) {
+	useTestFederation(t)
+
+	home := newActorServer(t)
+	other := newActorServer(t)
+	aliceKey, malloryKey := newRSAKey(t), newRSAKey(t)
+
+	alice := home.URL + "/users/alice"
+	aliceKeyID := alice + "#main-key"
+	home.publish(t, "/users/alice", aliceKeyID, alice, &aliceKey.PublicKey)
+
+	// Mallory's key document on another server names Alice as its owner.
+	otherOrigin := other.URL + "/users/mallory#main-key"
+	other.publish(t, "/users/mallory", otherOrigin, alice, &malloryKey.PublicKey)
+
+	// A key document on Alice's server that Alice's actor doesn't publish.
+	unpublished := home.URL + "/keys/mallory"
+	home.publish(t, "/keys/mallory", unpublished, alice, &malloryKey.PublicKey)
+
+	body := []byte(`{"type":"Follow"}`)
+
+	tests := []struct {
+		name   string
+		keyID  string
+		key    *rsa.PrivateKey
+		tamper func(r *http.Request)
+		body   []byte
+		owner  string
+	}{
+		{name: "valid", keyID: aliceKeyID, key: aliceKey, owner: alice},
+		{name: "body changed", keyID: aliceKeyID, key: aliceKey, body: []byte(`{"type":"Delete"}`)},
+		{name: "digest changed with body", keyID: aliceKeyID, key: aliceKey, body: []byte(`{"type":"Delete"}`),
+			tamper: func(r *http.Request) {
+				digest := sha256.Sum256([]byte(`{"type":"Delete"}`))
+				r.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+			}},
+		{name: "path changed", keyID: aliceKeyID, key: aliceKey,
+			tamper: func(r *http.Request) { r.URL.Path = "/ap/users/2/inbox" }},
+		{name: "date too old", keyID: aliceKeyID, key: aliceKey,
+			tamper: func(r *http.Request) {
+				r.Header.Set("Date", time.Now().Add(-2*time.Hour).UTC().Format(http.TimeFormat))
+			}},
+		{name: "digest not signed", keyID: aliceKeyID, key: aliceKey,
+			tamper: func(r *http.Request) {
+				r.Header.Set("Signature", strings.Replace(r.Header.Get("Signature"), " digest", "", 1))
+			}},
+		{name: "missing signature", keyID: aliceKeyID, key: aliceKey,
+			tamper: func(r *http.Request) { r.Header.Del("Signature") }},
+		{name: "signed with another key", keyID: aliceKeyID, key: malloryKey},
+		{name: "owner on another origin", keyID: otherOrigin, key: malloryKey},
+		{name: "key not published by owner", keyID: unpublished, key: malloryKey},
+		{name: "unknown key", keyID: home.URL + "/users/nobody#main-key", key: aliceKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := signedInboxRequest(t, body, tt.keyID, tt.key)
+			if tt.tamper != nil {
+				tt.tamper(r)
+			}
+			received := body
+			if tt.body != nil {
+				received = tt.body
+			}
+
+			owner, err := verifyRequest(r, received)
+			if tt.owner == "" {
+				if err == nil {
+					t.Errorf("verified as %s", owner)
+				}
+				return
+			}
+			if err != nil || owner != tt.owner {
+				t.Errorf("verifyRequest = %q, %v; want %q", owner, err, tt.owner)
+			}
+		})
+	}
+}
+
+func TestVerifyRequestAfterKeyRotation(t *testing.T) {
+	useTestFederation(t)
+
+	home := newActorServer(t)
+	oldKey, newKey := newRSAKey(t), newRSAKey(t)
+	alice := home.URL + "/users/alice"
+	keyID := alice + "#main-key"
+	body := []byte(`{"type":"Create"}`)
+
+	home.publish(t, "/users/alice", keyID, alice, &oldKey.PublicKey)
+	if _, err := verifyRequest(signedInboxRequest(t, body, keyID, oldKey), body); err != nil {
+		t.Fatalf("old key: %v", err)
+	}
+
+	// The cached old key no longer verifies, so the key is fetched again.
+	home.publish(t, "/users/alice", keyID, alice, &newKey.PublicKey)
+	if _, err := verifyRequest(signedInboxRequest(t, body, keyID, newKey), body); err != nil {
+		t.Errorf("new key: %v", err)
+	}
+	if _, err := verifyRequest(signedInboxRequest(t, body, keyID, oldKey), body); err == nil {
+		t.Error("old key still accepted after rotation")
+	}
+}
+
+func TestPrivateAddressesBlocked(t *testing.T) {
+	home := newActorServer(t)
+	key := newRSAKey(t)
+	alice := home.URL + "/users/alice"
+	home.publish(t, "/users/alice", alice+"#main-key", alice, &key.PublicKey)
+
+	saved := apClient
+	apClient = newAPClient(false)
+	clearKeyCache()
+	t.Cleanup(func() { apClient = saved })
+
+	body := []byte(`{}`)
+	if _, err := verifyRequest(signedInboxRequest(t, body, alice+"#main-key", key), body); err == nil {
+		t.Error("fetched a key from a loopback address")
+	}
+}
+
+func TestCacheKeyEviction(t *testing.T) {
+	clearKeyCache()
+	t.Cleanup(clearKeyCache)
+
+	start := time.Now()
+	for i := 0; i < maxCachedKeys; i++ {
+		cacheKey(fmt.Sprintf("key-%d", i), cachedKey{fetchedAt: start.Add(time.Duration(i) * time.Second)})
+	}
+
+	// A full cache drops the oldest key to make room.
+	cacheKey("newest", cachedKey{fetchedAt: start.Add(maxCachedKeys * time.Second)})
+	if len(publicKeyCache) != maxCachedKeys {
+		t.Fatalf("cache holds %d keys, want %d", len(publicKeyCache), maxCachedKeys)
+	}
+	if _, ok := publicKeyCache["key-0"]; ok {
+		t.Error("oldest key was not evicted")
+	}
+
+	// Refreshing a cached key doesn't evict anything.
+	cacheKey("key-1", cachedKey{fetchedAt: start.Add(maxCachedKeys * time.Second)})
+	if len(publicKeyCache) != maxCachedKeys {
+		t.Errorf("cache holds %d keys after a refresh, want %d", len(publicKeyCache), maxCachedKeys)
+	}
+
+	// Once keys have expired they all go at once: here key-2 to key-500,
+	// since key-1 was just refreshed.
+	cacheKey("later", cachedKey{fetchedAt: start.Add(publicKeyTTL + 500*time.Second)})
+	if want := maxCachedKeys - 499 + 1; len(publicKeyCache) != want {
+		t.Errorf("cache holds %d keys, want %d", len(publicKeyCache), want)
+	}
+	if _, ok := publicKeyCache["key-1"]; !ok {
+		t.Error("a recently refreshed key was dropped")
+	}
+}
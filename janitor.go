@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/Delvoid/chirpy/database"
+)
+
+// janitorJob removes stale data and reports how many records it removed.
+// Each job runs at startup and then every interval; a zero interval disables
+// it.
+type janitorJob struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context, now time.Time) (int, error)
+}
+
+// janitorJobs lists the maintenance the server does in the background. The
+// store keeps no webhook log and no chirp tombstones, so tokens are all
+// that expire.
+func janitorJobs(conf config) []janitorJob {
+	return []janitorJob{
+		{"refresh_tokens", conf.RefreshPurgeInterval, database.PurgeExpiredRefreshTokens},
+		{"mail_tokens", conf.MailPurgeInterval, database.PurgeExpiredMailTokens},
+	}
+}
+
+// janitor runs janitorJobs on their own schedules until stopped.
+type janitor struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func startJanitor(jobs []janitorJob) *janitor {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &janitor{cancel: cancel}
+
+	for _, job := range jobs {
+		if job.interval <= 0 {
+			continue
+		}
+
+		j.wg.Add(1)
+		go func(job janitorJob) {
+			defer j.wg.Done()
+
+			ticker := time.NewTicker(job.interval)
+			defer ticker.Stop()
+			for {
+				runJanitorJob(ctx, job)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(job)
+	}
+	return j
+}
+
+func runJanitorJob(ctx context.Context, job janitorJob) {
+	ctx, span := tracer.Start(ctx, "janitor."+job.name)
+	defer span.End()
+
+	start := time.Now()
+	removed, err := job.run(ctx, start)
+	janitorDuration.WithLabelValues(job.name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		spanError(span, err)
+		janitorRuns.WithLabelValues(job.name, "error").Inc()
+		slog.ErrorContext(ctx, "janitor job failed", "job", job.name, "error", err)
+		return
+	}
+
+	janitorRuns.WithLabelValues(job.name, "ok").Inc()
+	janitorRemoved.WithLabelValues(job.name).Add(float64(removed))
+	janitorLastSuccess.WithLabelValues(job.name).SetToCurrentTime()
+	if removed > 0 {
+		slog.InfoContext(ctx, "janitor removed stale data", "job", job.name, "removed", removed)
+	}
+}
+
+// stop prevents further runs and waits for running jobs to finish, giving
+// up when ctx expires.
+func (j *janitor) stop(ctx context.Context) error {
+	j.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		j.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// jwtAlgorithms are the values jwt_algorithm accepts.
+var jwtAlgorithms = []string{"HS256", "RS256", "EdDSA"}
+
+// minRSABits is the smallest RSA key accepted for signing or verifying.
+const minRSABits = 2048
+
+// jwtKey is one key in the keyring. Tokens name the key that signed them in
+// their kid header, and a key only verifies tokens of its own algorithm.
+type jwtKey struct {
+	id     string
+	method jwt.SigningMethod
+	// signer is nil for keys that only verify tokens issued before a
+	// rotation.
+	signer interface{}
+	// verifier is the HMAC secret or the public key.
+	verifier interface{}
+}
+
+// keyring signs access tokens with its active key and verifies them with
+// any of its keys.
+type keyring struct {
+	active *jwtKey
+	keys   map[string]*jwtKey
+	// legacy are the HMAC keys that may verify tokens without a kid. Those
+	// were signed with whatever jwt_secret was before key IDs existed,
+	// which may since have moved to jwt_previous_secrets.
+	legacy []*jwtKey
+}
+
+// newKeyring builds the keyring from the jwt_* settings. The active key is
+// jwt_secret for HS256 or jwt_private_key_file otherwise; retired keys from
+// jwt_previous_secrets and jwt_verify_key_files still verify tokens.
+func newKeyring(conf config) (*keyring, error) {
+	ring := &keyring{keys: make(map[string]*jwtKey)}
+
+	var active *jwtKey
+	switch conf.JWTAlgorithm {
+	case "HS256":
+		active = hmacKey(conf.JWTSecret)
+		ring.legacy = append(ring.legacy, active)
+	default:
+		key, err := loadJWTKey(conf.JWTPrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key.signer == nil {
+			return nil, fmt.Errorf("%s: not a private key", conf.JWTPrivateKeyFile)
+		}
+		if key.method.Alg() != conf.JWTAlgorithm {
+			return nil, fmt.Errorf("%s: %s key can't be used with jwt_algorithm %s", conf.JWTPrivateKeyFile, key.method.Alg(), conf.JWTAlgorithm)
+		}
+		active = key
+	}
+	ring.active = active
+	ring.keys[active.id] = active
+
+	for _, secret := range splitList(conf.JWTPreviousSecrets) {
+		key := hmacKey(secret)
+		key.signer = nil
+		if _, ok := ring.keys[key.id]; !ok {
+			ring.keys[key.id] = key
+			ring.legacy = append(ring.legacy, key)
+		}
+	}
+
+	for _, path := range splitList(conf.JWTVerifyKeyFiles) {
+		key, err := loadJWTKey(path)
+		if err != nil {
+			return nil, err
+		}
+		key.signer = nil
+		ring.add(key)
+	}
+
+	return ring, nil
+}
+
+// add adds a verify-only key unless the ring already has it.
+func (ring *keyring) add(key *jwtKey) {
+	if _, ok := ring.keys[key.id]; !ok {
+		ring.keys[key.id] = key
+	}
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// algorithms lists the algorithms of the ring's keys. Tokens using any
+// other algorithm, including "none", are refused.
+func (ring *keyring) algorithms() []string {
+	seen := make(map[string]bool)
+	var algs []string
+	for _, key := range ring.keys {
+		if alg := key.method.Alg(); !seen[alg] {
+			seen[alg] = true
+			algs = append(algs, alg)
+		}
+	}
+	sort.Strings(algs)
+	return algs
+}
+
+// sign signs claims with the active key.
+func (ring *keyring) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ring.active.method, claims)
+	token.Header["kid"] = ring.active.id
+	return token.SignedString(ring.active.signer)
+}
+
+// parse verifies tokenString with the key named by its kid header and
+// decodes its claims. Tokens without a kid are tried against each legacy
+// key in turn.
+func (ring *keyring) parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	parser := jwt.Parser{ValidMethods: ring.algorithms()}
+
+	unverified, _, err := parser.ParseUnverified(tokenString, claims)
+	if err != nil {
+		return nil, err
+	}
+	if kid, _ := unverified.Header["kid"].(string); kid != "" {
+		key, ok := ring.keys[kid]
+		if !ok {
+			return nil, errors.New("unknown signing key")
+		}
+		return parser.ParseWithClaims(tokenString, claims, key.verifierFor)
+	}
+
+	err = errors.New("no key verifies tokens without a kid")
+	for _, key := range ring.legacy {
+		var token *jwt.Token
+		token, err = parser.ParseWithClaims(tokenString, claims, key.verifierFor)
+		if err == nil {
+			return token, nil
+		}
+	}
+	return nil, err
+}
+
+// verifierFor is a jwt.Keyfunc that only lets the key verify tokens of its
+// own algorithm.
+func (key *jwtKey) verifierFor(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("key %s does not sign with %s", key.id, token.Method.Alg())
+	}
+	return key.verifier, nil
+}
+
+func hmacKey(secret string) *jwtKey {
+	sum := sha256.Sum256([]byte("chirpy jwt kid\x00" + secret))
+	return &jwtKey{
+		id:       "hs-" + base64.RawURLEncoding.EncodeToString(sum[:12]),
+		method:   jwt.SigningMethodHS256,
+		signer:   []byte(secret),
+		verifier: []byte(secret),
+	}
+}
+
+// loadJWTKey reads an RSA or Ed25519 key from a PEM file. Private keys may
+// be PKCS #8 or PKCS #1, public keys PKIX or PKCS #1.
+func loadJWTKey(path string) (*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var signer interface{}
+	if private, ok := parsed.(crypto.Signer); ok {
+		signer = private
+		parsed = private.Public()
+	}
+
+	key := &jwtKey{signer: signer, verifier: parsed}
+	switch public := parsed.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("%s: RSA keys must be at least %d bits", path, minRSABits)
+		}
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.method = signingMethodEdDSA
+	default:
+		return nil, fmt.Errorf("%s: only RSA and Ed25519 keys are supported", path)
+	}
+	key.id = thumbprint(publicJWK(key))
+	return key, nil
+}
+
+// jwk is a public key in JSON Web Key form (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// publicJWK describes an asymmetric key without its kid.
+func publicJWK(key *jwtKey) jwk {
+	switch public := key.verifier.(type) {
+	case *rsa.PublicKey:
+		return jwk{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}
+	case ed25519.PublicKey:
+		return jwk{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(public)}
+	}
+	return jwk{}
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint, used as the kid of asymmetric
+// keys so it is the same wherever the key is loaded.
+func thumbprint(k jwk) string {
+	// The required members in lexicographic order, without whitespace.
+	var canonical string
+	switch k.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, k.Crv, k.X)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// jwksHandler publishes the public keys that verify Chirpy access tokens,
+// retired ones included, so other services can check tokens themselves.
+// HS256 secrets are never published.
+func jwksHandler(jwtKeys *keyring) http.HandlerFunc {
+	keys := []jwk{}
+	for _, key := range jwtKeys.keys {
+		if _, ok := key.verifier.([]byte); ok {
+			continue
+		}
+		k := publicJWK(key)
+		k.Use = "sig"
+		k.Alg = key.method.Alg()
+		k.Kid = key.id
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Kid < keys[j].Kid })
+
+	jwks := struct {
+		Keys []jwk `json:"keys"`
+	}{keys}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		respondWithJSON(w, jwks, http.StatusOK)
+	}
+}
+
+// signingMethodEdDSA adds Ed25519 (RFC 8037) to jwt-go, which predates it.
+var signingMethodEdDSA = &edDSAMethod{}
+
+func init() {
+	jwt.RegisterSigningMethod(signingMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return signingMethodEdDSA
+	})
+}
+
+type edDSAMethod struct{}
+
+func (m *edDSAMethod) Alg() string { return "EdDSA" }
+
+func (m *edDSAMethod) Sign(signingString string, key interface{}) (string, error) {
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(private, []byte(signingString))), nil
+}
+
+func (m *edDSAMethod) Verify(signingString, signature string, key interface{}) error {
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(public, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
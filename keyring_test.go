@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func testClaims() *accessClaims {
+	return &accessClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "1",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+	}
+}
+
+// legacyToken signs a token the way Chirpy did before key IDs existed.
+func legacyToken(t *testing.T, secret string) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims()).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func ed25519KeyFile(t *testing.T) string {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, "PRIVATE KEY", der)
+}
+
+func rsaKeyFile(t *testing.T) (string, *rsa.PrivateKey) {
+	t.Helper()
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(private)), private
+}
+
+func mustKeyring(t *testing.T, conf config) *keyring {
+	t.Helper()
+	ring, err := newKeyring(conf)
+	if err != nil {
+		t.Fatalf("newKeyring: %v", err)
+	}
+	return ring
+}
+
+func hmacConfig(secret, previous string) config {
+	conf := defaultConfig()
+	conf.JWTSecret = secret
+	conf.JWTPreviousSecrets = previous
+	return conf
+}
+
+func TestKeyringSecretRotation(t *testing.T) {
+	before := mustKeyring(t, hmacConfig("old-secret", ""))
+	signedBefore, err := before.sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedLegacy := legacyToken(t, "old-secret")
+
+	tests := []struct {
+		name  string
+		conf  config
+		token string
+		ok    bool
+	}{
+		{"kid token before rotation", hmacConfig("old-secret", ""), signedBefore, true},
+		{"legacy token before rotation", hmacConfig("old-secret", ""), signedLegacy, true},
+		{"kid token after rotation", hmacConfig("new-secret", "old-secret"), signedBefore, true},
+		{"legacy token after rotation", hmacConfig("new-secret", "old-secret"), signedLegacy, true},
+		{"legacy token after two rotations", hmacConfig("newest-secret", "new-secret,old-secret"), signedLegacy, true},
+		{"kid token once the old secret is dropped", hmacConfig("new-secret", ""), signedBefore, false},
+		{"legacy token once the old secret is dropped", hmacConfig("new-secret", ""), signedLegacy, false},
+		{"legacy token signed with an unknown secret", hmacConfig("new-secret", "old-secret"), legacyToken(t, "other"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := mustKeyring(t, tt.conf)
+			_, err := ring.parse(tt.token, &accessClaims{})
+			if ok := err == nil; ok != tt.ok {
+				t.Errorf("parse: err = %v, want ok = %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestKeyringAsymmetricRotation(t *testing.T) {
+	edFile := ed25519KeyFile(t)
+	rsaFile, _ := rsaKeyFile(t)
+
+	hs := mustKeyring(t, hmacConfig("secret", ""))
+	hsToken, _ := hs.sign(testClaims())
+
+	edConf := hmacConfig("secret", "secret")
+	edConf.JWTAlgorithm = "EdDSA"
+	edConf.JWTPrivateKeyFile = edFile
+	ed := mustKeyring(t, edConf)
+	edToken, _ := ed.sign(testClaims())
+
+	rsConf := hmacConfig("secret", "secret")
+	rsConf.JWTAlgorithm = "RS256"
+	rsConf.JWTPrivateKeyFile = rsaFile
+	rsConf.JWTVerifyKeyFiles = edFile
+	rs := mustKeyring(t, rsConf)
+	rsToken, _ := rs.sign(testClaims())
+
+	for name, token := range map[string]string{"HS256": hsToken, "EdDSA": edToken, "RS256": rsToken} {
+		if _, err := rs.parse(token, &accessClaims{}); err != nil {
+			t.Errorf("%s token rejected after rotating to RS256: %v", name, err)
+		}
+	}
+	if _, err := ed.parse(rsToken, &accessClaims{}); err == nil {
+		t.Error("EdDSA keyring accepted a token from an RSA key it doesn't know")
+	}
+}
+
+func TestKeyringRejectsForgedTokens(t *testing.T) {
+	rsaFile, private := rsaKeyFile(t)
+	conf := hmacConfig("secret", "")
+	conf.JWTAlgorithm = "RS256"
+	conf.JWTPrivateKeyFile = rsaFile
+	ring := mustKeyring(t, conf)
+
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, testClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Algorithm confusion: an HS256 token whose HMAC secret is the public
+	// key, naming the RSA key as its kid.
+	publicDER, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	confused := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+	confused.Header["kid"] = ring.active.id
+	confusedToken, err := confused.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknown := jwt.NewWithClaims(jwt.SigningMethodRS256, testClaims())
+	unknown.Header["kid"] = "no-such-key"
+	unknownToken, err := unknown.SignedString(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiredClaims := testClaims()
+	expiredClaims.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	expired, err := ring.sign(expiredClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"alg none":            none,
+		"algorithm confusion": confusedToken,
+		"unknown kid":         unknownToken,
+		"expired":             expired,
+		"garbage":             "not.a.token",
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ring.parse(token, &accessClaims{}); err == nil {
+				t.Error("token was accepted")
+			}
+		})
+	}
+}
+
+func TestNewKeyringErrors(t *testing.T) {
+	edFile := ed25519KeyFile(t)
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallFile := writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(small))
+	publicDER, err := x509.MarshalPKIXPublicKey(small.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicFile := writePEM(t, "PUBLIC KEY", publicDER)
+
+	tests := []struct {
+		name string
+		alg  string
+		file string
+	}{
+		{"missing file", "EdDSA", filepath.Join(t.TempDir(), "missing.pem")},
+		{"wrong algorithm for key", "RS256", edFile},
+		{"RSA key too small", "RS256", smallFile},
+		{"public key cannot sign", "RS256", publicFile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := hmacConfig("secret", "")
+			conf.JWTAlgorithm = tt.alg
+			conf.JWTPrivateKeyFile = tt.file
+			if _, err := newKeyring(conf); err == nil {
+				t.Error("newKeyring succeeded")
+			}
+		})
+	}
+}
+
+func TestJWKSPublishesOnlyPublicKeys(t *testing.T) {
+	edFile := ed25519KeyFile(t)
+	rsaFile, _ := rsaKeyFile(t)
+	conf := hmacConfig("secret", "old-secret")
+	conf.JWTAlgorithm = "EdDSA"
+	conf.JWTPrivateKeyFile = edFile
+	conf.JWTVerifyKeyFiles = rsaFile
+	ring := mustKeyring(t, conf)
+
+	rec := httptest.NewRecorder()
+	jwksHandler(ring)(rec, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &jwks); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("got %d keys, want the Ed25519 and RSA keys only", len(jwks.Keys))
+	}
+	for _, k := range jwks.Keys {
+		key, ok := ring.keys[k.Kid]
+		if !ok {
+			t.Errorf("published kid %s is not in the keyring", k.Kid)
+			continue
+		}
+		if k.Alg != key.method.Alg() || k.Use != "sig" {
+			t.Errorf("key %s: alg %q use %q", k.Kid, k.Alg, k.Use)
+		}
+		k.Kid, k.Alg, k.Use = "", "", ""
+		if thumbprint(k) != key.id {
+			t.Errorf("key %s: kid is not the JWK thumbprint", key.id)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Delvoid/chirpy/database"
+)
+
+const (
+	loginDelayBase = 250 * time.Millisecond
+	loginDelayMax  = 5 * time.Second
+)
+
+// loginAttempts tracks recent failures for one email or client IP.
+type loginAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// loginGuard slows down and then locks out repeated failed logins, both per
+// email and per client IP. Emails are tracked whether or not an account
+// exists, so lockouts don't reveal which addresses are registered.
+type loginGuard struct {
+	accountThreshold int
+	ipThreshold      int
+	lockout          time.Duration
+
+	// dummyHash is compared against when the email is unknown so those
+	// attempts take as long as real ones.
+	dummyHash string
+
+	mu        sync.Mutex
+	accounts  map[string]*loginAttempts
+	ips       map[string]*loginAttempts
+	lastSweep time.Time
+}
+
+// newLoginGuard must be called after database.SetHasher so the dummy hash
+// costs as much to check as real ones.
+func newLoginGuard(accountThreshold, ipThreshold int, lockout time.Duration) (*loginGuard, error) {
+	dummyHash, err := database.HashPassword(context.Background(), "chirpy-dummy-password")
+	if err != nil {
+		return nil, err
+	}
+
+	return &loginGuard{
+		accountThreshold: accountThreshold,
+		ipThreshold:      ipThreshold,
+		lockout:          lockout,
+		dummyHash:        string(dummyHash),
+		accounts:         make(map[string]*loginAttempts),
+		ips:              make(map[string]*loginAttempts),
+	}, nil
+}
+
+func loginKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// locked reports how long the email or IP remains locked out, if at all.
+func (g *loginGuard) locked(email, ip string, now time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var wait time.Duration
+	for _, a := range []*loginAttempts{g.accounts[loginKey(email)], g.ips[ip]} {
+		if a != nil && a.lockedUntil.After(now) && a.lockedUntil.Sub(now) > wait {
+			wait = a.lockedUntil.Sub(now)
+		}
+	}
+	return wait
+}
+
+// fail records a failed attempt and returns how long to wait before
+// responding. The delay doubles with each consecutive failure.
+func (g *loginGuard) fail(email, ip string, now time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	accountFailures := g.record(g.accounts, loginKey(email), g.accountThreshold, now)
+	ipFailures := g.record(g.ips, ip, g.ipThreshold, now)
+	g.sweep(now)
+
+	failures := accountFailures
+	if ipFailures > failures {
+		failures = ipFailures
+	}
+	delay := loginDelayBase << (failures - 1)
+	if failures > 8 || delay > loginDelayMax {
+		delay = loginDelayMax
+	}
+	return delay
+}
+
+// record counts a failure and locks the key once it reaches threshold.
+// Failures older than the lockout period are forgotten. It returns the
+// number of consecutive failures including this one.
+func (g *loginGuard) record(attempts map[string]*loginAttempts, key string, threshold int, now time.Time) int {
+	a, ok := attempts[key]
+	if !ok || now.Sub(a.lastFailure) > g.lockout {
+		a = &loginAttempts{}
+		attempts[key] = a
+	}
+
+	a.failures++
+	a.lastFailure = now
+	failures := a.failures
+	if a.failures >= threshold {
+		a.lockedUntil = now.Add(g.lockout)
+		a.failures = 0
+	}
+	return failures
+}
+
+// sweep forgets entries with no recent failures and no active lockout. It
+// runs at most once per lockout period.
+func (g *loginGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < g.lockout {
+		return
+	}
+	g.lastSweep = now
+
+	for _, attempts := range []map[string]*loginAttempts{g.accounts, g.ips} {
+		for key, a := range attempts {
+			if now.Sub(a.lastFailure) > g.lockout && now.After(a.lockedUntil) {
+				delete(attempts, key)
+			}
+		}
+	}
+}
+
+// succeed clears the failures for an email after a successful login.
+func (g *loginGuard) succeed(email string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.accounts, loginKey(email))
+}
+
+// unlock lifts any lockout on an email and forgets its failures. It reports
+// whether there was anything to clear.
+func (g *loginGuard) unlock(email string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, ok := g.accounts[loginKey(email)]
+	delete(g.accounts, loginKey(email))
+	return ok
+}
+
+// sleep waits for d or until the request is abandoned.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+func unlockUserHandler(guard *loginGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("userID"))
+		if err != nil {
+			respondWithError(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		user, err := database.GetUserByID(r.Context(), userID)
+		if err != nil {
+			if errors.Is(err, database.ErrUserNotFound) {
+				respondWithError(w, "User not found", http.StatusNotFound)
+			} else {
+				respondWithError(w, "Failed to load user", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		respondWithJSON(w, struct {
+			ID       int  `json:"id"`
+			Unlocked bool `json:"unlocked"`
+		}{
+			ID:       user.ID,
+			Unlocked: guard.unlock(user.Email),
+		}, http.StatusOK)
+	}
+}
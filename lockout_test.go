@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testLoginGuard(accountThreshold, ipThreshold int) *loginGuard {
+	return &loginGuard{
+		accountThreshold: accountThreshold,
+		ipThreshold:      ipThreshold,
+		lockout:          15 * time.Minute,
+		accounts:         make(map[string]*loginAttempts),
+		ips:              make(map[string]*loginAttempts),
+	}
+}
+
+func TestLoginGuardDelays(t *testing.T) {
+	g := testLoginGuard(100, 100)
+	now := time.Now()
+
+	want := []time.Duration{
+		250 * time.Millisecond,
+		500 * time.Millisecond,
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		5 * time.Second,
+		5 * time.Second,
+	}
+	for i, w := range want {
+		if got := g.fail("walt@example.com", "203.0.113.1", now); got != w {
+			t.Errorf("failure %d: delay %v, want %v", i+1, got, w)
+		}
+	}
+
+	// Capped even after many more failures, where the shift would
+	// overflow.
+	for i := 0; i < 70; i++ {
+		if got := g.fail("walt@example.com", "203.0.113.1", now); got != loginDelayMax {
+			t.Fatalf("failure %d: delay %v, want %v", len(want)+i+1, got, loginDelayMax)
+		}
+	}
+}
+
+func TestLoginGuardLockout(t *testing.T) {
+	const (
+		email = "walt@example.com"
+		ip    = "203.0.113.1"
+	)
+	start := time.Now()
+
+	tests := []struct {
+		name string
+		// failures are recorded for these email/IP pairs at start.
+		failures [][2]string
+		email    string
+		ip       string
+		after    time.Duration
+		locked   bool
+	}{
+		{"below threshold", repeat(email, ip, 2), email, ip, 0, false},
+		{"account locked", repeat(email, ip, 3), email, "198.51.100.7", 0, true},
+		{"email is case-insensitive", repeat("Walt@Example.com ", ip, 3), email, "198.51.100.7", 0, true},
+		{"other accounts unaffected", repeat(email, "198.51.100.7", 3), "jesse@example.com", ip, 0, false},
+		{"IP locked across accounts", spread(ip, 5), "new@example.com", ip, 0, true},
+		{"lockout expires", repeat(email, ip, 3), email, ip, 16 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testLoginGuard(3, 5)
+			for _, f := range tt.failures {
+				g.fail(f[0], f[1], start)
+			}
+			wait := g.locked(tt.email, tt.ip, start.Add(tt.after))
+			if locked := wait > 0; locked != tt.locked {
+				t.Errorf("locked = %v (wait %v), want %v", locked, wait, tt.locked)
+			}
+		})
+	}
+}
+
+func repeat(email, ip string, n int) [][2]string {
+	var failures [][2]string
+	for i := 0; i < n; i++ {
+		failures = append(failures, [2]string{email, ip})
+	}
+	return failures
+}
+
+// spread fails once for each of n different emails from one IP.
+func spread(ip string, n int) [][2]string {
+	var failures [][2]string
+	for i := 0; i < n; i++ {
+		failures = append(failures, [2]string{string(rune('a'+i)) + "@example.com", ip})
+	}
+	return failures
+}
+
+func TestLoginGuardForgetsOldFailures(t *testing.T) {
+	g := testLoginGuard(3, 100)
+	start := time.Now()
+
+	g.fail("walt@example.com", "203.0.113.1", start)
+	g.fail("walt@example.com", "203.0.113.1", start)
+	// Long enough after the last failure that the count starts over.
+	g.fail("walt@example.com", "203.0.113.1", start.Add(20*time.Minute))
+
+	if wait := g.locked("walt@example.com", "203.0.113.1", start.Add(20*time.Minute)); wait != 0 {
+		t.Errorf("locked for %v after failures spread over the lockout period", wait)
+	}
+}
+
+func TestLoginGuardSucceedAndUnlock(t *testing.T) {
+	now := time.Now()
+
+	g := testLoginGuard(3, 100)
+	g.fail("walt@example.com", "203.0.113.1", now)
+	g.fail("walt@example.com", "203.0.113.1", now)
+	g.succeed("WALT@example.com")
+	g.fail("walt@example.com", "203.0.113.1", now)
+	if wait := g.locked("walt@example.com", "203.0.113.1", now); wait != 0 {
+		t.Errorf("succeed did not reset the failure count; locked for %v", wait)
+	}
+
+	g = testLoginGuard(3, 100)
+	for i := 0; i < 3; i++ {
+		g.fail("walt@example.com", "203.0.113.1", now)
+	}
+	if !g.unlock("walt@example.com") {
+		t.Error("unlock reported nothing to clear")
+	}
+	if wait := g.locked("walt@example.com", "203.0.113.1", now); wait != 0 {
+		t.Errorf("still locked for %v after unlock", wait)
+	}
+	if g.unlock("walt@example.com") {
+		t.Error("second unlock reported something to clear")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends email on behalf of the server.
+type Mailer interface {
+	Send(ctx context.Context, msg mailMessage) error
+}
+
+type mailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// format renders the message as a plain text RFC 5322 email. Addresses come
+// from users, so line breaks that would inject headers are refused.
+func (m mailMessage) format(from string) ([]byte, error) {
+	if strings.ContainsAny(m.To+from, "\r\n") {
+		return nil, errors.New("mail address contains a line break")
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(m.Body)
+	b.WriteString("\r\n")
+	return b.Bytes(), nil
+}
+
+// sendInBackground sends mail after the handler returns, so a slow mail
+// server doesn't hold up the response. Failures are logged.
+func sendInBackground(r *http.Request, what string, send func(ctx context.Context) error) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	stop := context.AfterFunc(mailCtx, cancel)
+
+	sending.Add(1)
+	go func() {
+		defer sending.Done()
+		defer cancel()
+		defer stop()
+
+		if err := send(ctx); err != nil {
+			slog.ErrorContext(ctx, "sending mail failed", "mail", what, "error", err)
+		}
+	}()
+}
+
+// Mail sent in the background is tracked through sending so shutdown can
+// wait for it; stopMail cancels whatever is still being sent.
+var (
+	sending           sync.WaitGroup
+	mailCtx, stopMail = context.WithCancel(context.Background())
+)
+
+// waitForMail waits for background mail to be sent. If ctx expires first
+// the remaining sends are cancelled and abandoned, since an SMTP exchange
+// can't be interrupted.
+func waitForMail(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		sending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		stopMail()
+		return ctx.Err()
+	}
+}
+
+// mailers builds the Mailer selected by the mailer setting. The log and file
+// mailers are meant for local development.
+var mailers = map[string]func(conf config) (Mailer, error){
+	"log": func(conf config) (Mailer, error) {
+		return logMailer{}, nil
+	},
+	"file": func(conf config) (Mailer, error) {
+		return &fileMailer{path: conf.MailFile, from: conf.MailFrom}, nil
+	},
+	"smtp": func(conf config) (Mailer, error) {
+		host, _, err := net.SplitHostPort(conf.SMTPAddr)
+		if err != nil {
+			return nil, fmt.Errorf("smtp_addr: %w", err)
+		}
+		m := smtpMailer{addr: conf.SMTPAddr, from: conf.MailFrom}
+		if conf.SMTPUsername != "" {
+			m.auth = smtp.PlainAuth("", conf.SMTPUsername, conf.SMTPPassword, host)
+		}
+		return m, nil
+	},
+}
+
+func mailerNames() []string {
+	names := make([]string, 0, len(mailers))
+	for name := range mailers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// logMailer writes messages to the log instead of sending them.
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, msg mailMessage) error {
+	slog.InfoContext(ctx, "mail", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
+
+// fileMailer appends messages to a file, one after another.
+type fileMailer struct {
+	path string
+	from string
+
+	mu sync.Mutex
+}
+
+func (m *fileMailer) Send(ctx context.Context, msg mailMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, err := msg.format(m.from)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(m.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// smtpMailer sends messages through an SMTP relay, using STARTTLS when the
+// server offers it.
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m smtpMailer) Send(ctx context.Context, msg mailMessage) error {
+	_, span := tracer.Start(ctx, "smtp.send")
+	defer span.End()
+
+	data, err := msg.format(m.from)
+	if err == nil {
+		err = smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, data)
+	}
+	if err != nil {
+		spanError(span, err)
+	}
+	return err
+}
@@ -1,47 +1,42 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Delvoid/chirpy/database"
-	"github.com/joho/godotenv"
 )
 
 type apiConfig struct {
-	fileserverHits int
-	jwtSecret      string
-	polkaApiKey    string
+	hits        hitCounter
+	jwtKeys     *keyring
+	polkaApiKey string
 }
 
-func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
+func (cfg *apiConfig) resetHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.hits.reset()
+	w.WriteHeader(http.StatusOK)
+}
+
+// limitBodySize caps the size of every request body.
+func limitBodySize(maxBytes int64, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg.fileserverHits++
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (cfg *apiConfig) metricsHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
-	html := `
-    <html>
-    <body>
-        <h1>Welcome, Chirpy Admin</h1>
-        <p>Chirpy has been visited %d times!</p>
-    </body>
-    </html>
-`
-	fmt.Fprintf(w, html, cfg.fileserverHits)
-}
-
-func (cfg *apiConfig) resetHandler(w http.ResponseWriter, r *http.Request) {
-	cfg.fileserverHits = 0
-	w.WriteHeader(http.StatusOK)
-}
-
 func healthzHandlert(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
@@ -49,29 +44,43 @@ func healthzHandlert(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	debug := flag.Bool("debug", false, "Enable debug mode")
-	flag.Parse()
+	conf, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
 
-	const port = "8080"
-	cfg := &apiConfig{}
+	slog.SetDefault(newLogger(conf.LogLevel))
 
-	err := godotenv.Load()
+	shutdownTracing, err := setupTracing(conf)
 	if err != nil {
-		log.Fatalf("Failed to load .env file: %v", err)
+		log.Fatalf("Failed to set up tracing: %v", err)
 	}
 
-	// Set the JWT secret
-	cfg.jwtSecret = os.Getenv("JWT_SECRET")
-	if cfg.jwtSecret == "" {
-		log.Fatalf("JWT_SECRET environment variable is not set")
+	jwtKeys, err := newKeyring(conf)
+	if err != nil {
+		log.Fatalf("Failed to load JWT signing keys: %v", err)
 	}
 
-	cfg.polkaApiKey = os.Getenv("POLKA_API_KEY")
-	if cfg.polkaApiKey == "" {
-		log.Fatalf("POLKA_API_KEY environment variable is not set")
+	cfg := &apiConfig{
+		jwtKeys:     jwtKeys,
+		polkaApiKey: conf.PolkaAPIKey,
 	}
 
-	if *debug {
+	publicURL = conf.baseURL()
+	apClient = newAPClient(conf.FederationAllowPrivate)
+	database.SetPath(conf.DataPath)
+	database.SetHasher(passwordHashers[conf.PasswordHasher](conf))
+	database.SetPasswordPolicy(database.PasswordPolicy{
+		MinLength:    conf.PasswordMinLength,
+		RejectCommon: conf.PasswordRejectCommon,
+	})
+	database.SetMaxChirpLength(conf.MaxChirpLength)
+	database.SetObserver(observeStore)
+
+	if conf.Debug {
 		log.Println("Debug mode enabled")
 		err := database.RemoveDatabase()
 		if err != nil {
@@ -83,38 +92,242 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
+	bootstrapAdmin(context.Background(), conf.BootstrapAdminEmail)
+
+	guard, err := newLoginGuard(conf.LoginLockoutThreshold, conf.LoginIPLockoutThreshold, conf.LoginLockoutDuration)
+	if err != nil {
+		log.Fatalf("Failed to set up login protection: %v", err)
+	}
+
+	totpKey, previousTOTPKeys := conf.totpKeys()
+	box, err := newSecretBox(totpKey, previousTOTPKeys...)
+	if err != nil {
+		log.Fatalf("Failed to set up two-factor encryption: %v", err)
+	}
+	resealed, err := database.ResealTOTPSecrets(context.Background(), box.reseal)
+	if err != nil {
+		log.Printf("Failed to re-encrypt two-factor secrets: %v", err)
+	}
+	if resealed > 0 {
+		log.Printf("Re-encrypted %d two-factor secrets with the current key", resealed)
+	}
+	tf := newTwoFactor(box)
 
-	mux := http.NewServeMux()
+	mailer, err := mailers[conf.Mailer](conf)
+	if err != nil {
+		log.Fatalf("Failed to set up %s mailer: %v", conf.Mailer, err)
+	}
+	verifier := &emailVerifier{
+		mailer: mailer,
+		ttl:    conf.EmailVerificationTTL,
+		url:    conf.EmailVerificationURL,
+	}
+
+	mux := newMux(conf, cfg, guard, tf, mailer, verifier)
+
+	err = checkOpenAPISpec(mux.patterns)
+	if err != nil {
+		log.Fatalf("OpenAPI spec is out of date: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var handler http.Handler = limitBodySize(conf.MaxBodyBytes, mux)
+	if conf.RateLimit {
+		handler = rateLimitRequests(mux, cfg.jwtKeys, rateLimitPolicies, handler)
+	}
+	handler = hsts(conf.HSTSMaxAge, handler)
+	handler = instrumentRequests(mux, handler)
+	handler = logRequests(mux, handler)
+	handler = traceRequests(mux, handler)
+
+	server := &http.Server{
+		Addr:    conf.ListenAddr,
+		Handler: handler,
+	}
+	servers := []*http.Server{server}
+
+	if conf.TLSCertFile != "" {
+		certs, err := newCertReloader(conf.TLSCertFile, conf.TLSKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		certs.watchSIGHUP(ctx)
+
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.getCertificate,
+		}
+
+		if conf.HTTPRedirectAddr != "" {
+			servers = append(servers, &http.Server{
+				Addr:              conf.HTTPRedirectAddr,
+				Handler:           redirectToHTTPS(conf.ListenAddr),
+				ReadHeaderTimeout: 10 * time.Second,
+			})
+		}
+	}
+
+	listeners := make([]net.Listener, len(servers))
+	for i, server := range servers {
+		listeners[i], err = net.Listen("tcp", server.Addr)
+		if err != nil {
+			log.Fatalf("Failed to listen: %v", err)
+		}
+	}
+
+	jan := startJanitor(janitorJobs(conf))
+
+	err = serve(ctx, conf, jan, servers, listeners)
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if flushErr := shutdownTracing(flushCtx); flushErr != nil {
+		log.Printf("Failed to flush traces: %v", flushErr)
+	}
+
+	if err != nil {
+		log.Printf("Shutdown incomplete: %v", err)
+		os.Exit(1)
+	}
+	log.Println("Shutdown complete")
+}
+
+// newMux registers every route. All of them must be described in
+// openapi.json; see checkOpenAPISpec.
+func newMux(conf config, cfg *apiConfig, guard *loginGuard, tf *twoFactor, mailer Mailer, verifier *emailVerifier) *router {
+	mux := newRouter()
 
 	fileServer := http.FileServer(http.Dir("."))
-	appHandler := cfg.middlewareMetricsInc(http.StripPrefix("/app/", fileServer))
+	appHandler := cfg.hits.middleware(http.StripPrefix("/app/", fileServer))
 	mux.Handle("/app/", appHandler)
-	mux.HandleFunc("GET /admin/metrics", cfg.metricsHandler)
+	mux.HandleFunc("GET /admin/metrics", requireRole(cfg.jwtKeys, database.RoleAdmin, cfg.metricsHandler))
+	mux.HandleFunc("PUT /admin/users/{userID}/role", requireRole(cfg.jwtKeys, database.RoleAdmin, setRoleHandler))
+	mux.HandleFunc("POST /admin/users/{userID}/unlock", requireRole(cfg.jwtKeys, database.RoleAdmin, unlockUserHandler(guard)))
+	mux.HandleFunc("GET /metrics", requireRole(cfg.jwtKeys, database.RoleAdmin, metricsEndpoint().ServeHTTP))
 
 	mux.HandleFunc("GET /api/healthz", healthzHandlert)
-	mux.HandleFunc("GET /api/reset", cfg.resetHandler)
+	mux.HandleFunc("GET /api/livez", livezHandler)
+	mux.HandleFunc("GET /api/readyz", readyzHandler)
+	mux.HandleFunc("POST /api/reset", requireRole(cfg.jwtKeys, database.RoleAdmin, cfg.resetHandler))
+	mux.HandleFunc("GET /api/openapi.json", openAPIHandler)
 
-	mux.HandleFunc("POST /api/chirps", createChirpHandler(cfg.jwtSecret))
+	mux.HandleFunc("POST /api/chirps", createChirpHandler(cfg.jwtKeys))
 	mux.HandleFunc("GET /api/chirps", getChirpsHandler)
 	mux.HandleFunc("GET /api/chirps/{chirpID}", getChirpByIDHandler)
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", deleteChirpHandler(cfg.jwtSecret))
+	mux.HandleFunc("DELETE /api/chirps/{chirpID}", deleteChirpHandler(cfg.jwtKeys))
 
-	mux.HandleFunc("POST /api/users", createUserHandler)
-	mux.HandleFunc("POST /api/login", loginHandler(cfg.jwtSecret))
-	mux.HandleFunc("PUT /api/users", updateUserHandler(cfg.jwtSecret))
-	mux.HandleFunc("POST /api/refresh", refreshHandler(cfg.jwtSecret))
+	mux.HandleFunc("POST /api/users", createUserHandler(verifier))
+	mux.HandleFunc("POST /api/login", loginHandler(cfg.jwtKeys, conf.AccessTokenTTL, conf.RefreshTokenTTL, guard, tf))
+	mux.HandleFunc("POST /api/login/2fa", loginTwoFactorHandler(cfg.jwtKeys, conf.RefreshTokenTTL, guard, tf))
+	mux.HandleFunc("POST /api/users/2fa/setup", twoFactorSetupHandler(cfg.jwtKeys, tf))
+	mux.HandleFunc("POST /api/users/2fa/verify", twoFactorVerifyHandler(cfg.jwtKeys, tf))
+	mux.HandleFunc("POST /api/password/forgot", forgotPasswordHandler(mailer, conf.PasswordResetTTL, conf.PasswordResetURL))
+	mux.HandleFunc("POST /api/password/reset", resetPasswordHandler(guard))
+	mux.HandleFunc("PUT /api/users", updateUserHandler(cfg.jwtKeys, verifier))
+	mux.HandleFunc("POST /api/users/verify", verifyEmailHandler(conf.BootstrapAdminEmail))
+	mux.HandleFunc("POST /api/users/verify/resend", resendVerificationHandler(cfg.jwtKeys, verifier))
+	mux.HandleFunc("POST /api/refresh", refreshHandler(cfg.jwtKeys, conf.RefreshedAccessTokenTTL))
 	mux.HandleFunc("POST /api/revoke", revokeHandler)
+	mux.HandleFunc("GET /api/sessions", listSessionsHandler(cfg.jwtKeys))
+	mux.HandleFunc("DELETE /api/sessions", deleteAllSessionsHandler(cfg.jwtKeys))
+	mux.HandleFunc("DELETE /api/sessions/{sessionID}", deleteSessionHandler(cfg.jwtKeys))
+
+	mux.HandleFunc("GET /api/users/{userID}/feed.rss", userFeedHandler(feedRSS))
+	mux.HandleFunc("GET /api/users/{userID}/feed.atom", userFeedHandler(feedAtom))
+	mux.HandleFunc("GET /api/users/{userID}/feed.json", userFeedHandler(feedJSON))
+	mux.HandleFunc("GET /api/feed.rss", globalFeedHandler(feedRSS))
+	mux.HandleFunc("GET /api/feed.atom", globalFeedHandler(feedAtom))
+	mux.HandleFunc("GET /api/feed.json", globalFeedHandler(feedJSON))
+
+	mux.HandleFunc("POST /api/users/follow", followHandler(cfg.jwtKeys))
+	mux.HandleFunc("DELETE /api/users/follow", unfollowHandler(cfg.jwtKeys))
+
+	mux.HandleFunc("GET /.well-known/webfinger", webfingerHandler)
+	mux.HandleFunc("GET /.well-known/jwks.json", jwksHandler(cfg.jwtKeys))
+	mux.HandleFunc("GET /ap/users/{userID}", actorHandler)
+	mux.HandleFunc("GET /ap/users/{userID}/outbox", outboxHandler)
+	mux.HandleFunc("GET /ap/users/{userID}/followers", followersHandler)
+	mux.HandleFunc("GET /ap/users/{userID}/following", followingHandler)
+	mux.HandleFunc("POST /ap/users/{userID}/inbox", inboxHandler)
+	mux.HandleFunc("GET /ap/users/{userID}/inbox", inboxReadHandler(cfg.jwtKeys))
+	mux.HandleFunc("GET /ap/chirps/{chirpID}", noteHandler)
 
 	mux.HandleFunc("POST /api/polka/webhooks", polkaWebhookHandler(cfg.polkaApiKey))
 
-	server := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+	return mux
+}
+
+// serve runs each server on the listener at the same index until ctx is
+// cancelled, then stops accepting connections, drains in-flight requests,
+// background deliveries, outgoing mail and the janitor within
+// conf.ShutdownTimeout, and flushes the database. Servers with a TLSConfig
+// serve HTTPS.
+func serve(ctx context.Context, conf config, jan *janitor, servers []*http.Server, listeners []net.Listener) error {
+	// Request contexts derive from base so that handlers still running when
+	// the drain deadline passes are told to give up.
+	base, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	serveErr := make(chan error, len(servers))
+	for i, server := range servers {
+		server.BaseContext = func(net.Listener) context.Context { return base }
+
+		go func(server *http.Server, ln net.Listener) {
+			var err error
+			if server.TLSConfig != nil {
+				log.Printf("Starting HTTPS server on %s\n", ln.Addr())
+				err = server.ServeTLS(ln, "", "")
+			} else {
+				log.Printf("Starting server on %s\n", ln.Addr())
+				err = server.Serve(ln)
+			}
+			serveErr <- err
+		}(server, listeners[i])
 	}
 
-	log.Printf("Starting server on port: %s\n", port)
-	err = server.ListenAndServe()
-	if err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	var errs []error
+	stopped := 0
+	select {
+	case err := <-serveErr:
+		stopped++
+		errs = append(errs, fmt.Errorf("server failed: %w", err))
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, draining requests for up to %s", conf.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			cancelRequests()
+			server.Close()
+			errs = append(errs, fmt.Errorf("draining requests on %s: %w", server.Addr, err))
+		}
+	}
+	for ; stopped < len(servers); stopped++ {
+		if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := waitForDeliveries(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("waiting for deliveries: %w", err))
+	}
+
+	if err := waitForMail(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("waiting for outgoing mail: %w", err))
 	}
+
+	if err := jan.stop(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("stopping janitor: %w", err))
+	}
+
+	if err := database.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("flushing database: %w", err))
+	}
+
+	return errors.Join(errs...)
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Delvoid/chirpy/database"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testInstanceEnv) != "" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func TestServeShutsDownGracefully(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	database.SetPath(path)
+	if err := database.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+	mux.HandleFunc("GET /fast", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	ln := httptest.NewUnstartedServer(nil).Listener
+	url := "http://" + ln.Addr().String()
+	server := &http.Server{Handler: mux}
+
+	conf := defaultConfig()
+	conf.ShutdownTimeout = 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, conf, startJanitor(nil), []*http.Server{server}, []net.Listener{ln})
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		slow <- result{string(body), err}
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow request never reached the handler")
+	}
+
+	cancel()
+
+	// The listener closes once shutdown starts; until then new
+	// connections may still be accepted.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := client.Get(url + "/fast")
+		if err != nil {
+			break
+		}
+		resp.Body.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("new requests are still served after shutdown started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned before the in-flight request finished: %v", err)
+	default:
+	}
+
+	close(release)
+
+	res := <-slow
+	if res.err != nil {
+		t.Fatalf("in-flight request failed: %v", res.err)
+	}
+	if res.body != "done" {
+		t.Errorf("in-flight request body = %q, want %q", res.body, "done")
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after the in-flight request finished")
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("database was not flushed: %v", err)
+	}
+	if _, err := database.CreateUser(context.Background(), "late@example.com", "blue sky meth lab"); !errors.Is(err, database.ErrDatabaseClosed) {
+		t.Errorf("CreateUser after shutdown: got %v, want ErrDatabaseClosed", err)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Delvoid/chirpy/database"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricsRegistry holds every collector exposed on /metrics.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chirpy_http_requests_total",
+		Help: "HTTP requests by route pattern, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chirpy_http_request_duration_seconds",
+		Help:    "HTTP request latency by route pattern and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	fileserverHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chirpy_fileserver_hits_total",
+		Help: "Requests served under /app/.",
+	})
+
+	storeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chirpy_store_operation_duration_seconds",
+		Help:    "Database operation latency, including time spent waiting for the lock.",
+		Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+	}, []string{"op"})
+
+	loginFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chirpy_login_failures_total",
+		Help: "Failed login attempts by reason.",
+	}, []string{"reason"})
+
+	webhookEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chirpy_webhook_events_total",
+		Help: "Polka webhook deliveries by outcome.",
+	}, []string{"outcome"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chirpy_rate_limited_total",
+		Help: "Requests refused by the rate limiter, by route pattern.",
+	}, []string{"route"})
+
+	passwordRehashes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chirpy_password_rehashes_total",
+		Help: "Outdated password hashes replaced at login.",
+	})
+
+	refreshTokenReuse = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chirpy_refresh_token_reuse_total",
+		Help: "Already rotated refresh tokens presented again, each revoking a session.",
+	})
+
+	janitorRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chirpy_janitor_runs_total",
+		Help: "Background janitor runs by job and result.",
+	}, []string{"job", "result"})
+
+	janitorRemoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chirpy_janitor_removed_total",
+		Help: "Stale records removed by the background janitor, by job.",
+	}, []string{"job"})
+
+	janitorDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chirpy_janitor_run_duration_seconds",
+		Help:    "Background janitor run time by job.",
+		Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5},
+	}, []string{"job"})
+
+	janitorLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chirpy_janitor_last_success_timestamp_seconds",
+		Help: "Unix time of each janitor job's last successful run.",
+	}, []string{"job"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		fileserverHits,
+		storeDuration,
+		loginFailures,
+		webhookEvents,
+		rateLimited,
+		passwordRehashes,
+		refreshTokenReuse,
+		janitorRuns,
+		janitorRemoved,
+		janitorDuration,
+		janitorLastSuccess,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "chirpy_chirps",
+			Help: "Chirps currently stored.",
+		}, func() float64 {
+			chirps, _ := database.Counts()
+			return float64(chirps)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "chirpy_users",
+			Help: "Registered users.",
+		}, func() float64 {
+			_, users := database.Counts()
+			return float64(users)
+		}),
+	)
+}
+
+// observeStore records database operation timings reported through
+// database.SetObserver.
+func observeStore(op string, d time.Duration) {
+	storeDuration.WithLabelValues(op).Observe(d.Seconds())
+}
+
+// instrumentRequests counts requests and records their latency by route
+// pattern, so paths with IDs in them don't each get their own series.
+func instrumentRequests(mux *router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		httpRequests.WithLabelValues(pattern, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpDuration.WithLabelValues(pattern, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+func metricsEndpoint() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// hitCounter counts /app/ visits for the admin page. The Prometheus counter
+// only ever goes up, so a reset just moves the baseline it is compared to.
+type hitCounter struct {
+	baseline atomic.Uint64
+}
+
+func (h *hitCounter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileserverHits.Inc()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *hitCounter) value() uint64 {
+	return uint64(counterValue(fileserverHits)) - h.baseline.Load()
+}
+
+func (h *hitCounter) reset() {
+	h.baseline.Store(uint64(counterValue(fileserverHits)))
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
+
+func sumCounterVec(c *prometheus.CounterVec) float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var total float64
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err == nil {
+			total += m.GetCounter().GetValue()
+		}
+	}
+	return total
+}
+
+const adminMetricsHTML = `
+    <html>
+    <body>
+        <h1>Welcome, Chirpy Admin</h1>
+        <p>Chirpy has been visited %d times!</p>
+        <ul>
+            <li>Chirps: %d</li>
+            <li>Users: %d</li>
+            <li>API requests: %.0f</li>
+            <li>Failed logins: %.0f</li>
+            <li>Polka webhooks: %.0f</li>
+        </ul>
+        <p>Full metrics are available at <a href="/metrics">/metrics</a>.</p>
+    </body>
+    </html>
+`
+
+func (cfg *apiConfig) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	chirps, users := database.Counts()
+
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, adminMetricsHTML,
+		cfg.hits.value(),
+		chirps,
+		users,
+		sumCounterVec(httpRequests),
+		sumCounterVec(loginFailures),
+		sumCounterVec(webhookEvents),
+	)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// router is an http.ServeMux that remembers the patterns registered on it so
+// they can be checked against the OpenAPI document.
+type router struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func newRouter() *router {
+	return &router{ServeMux: http.NewServeMux()}
+}
+
+func (rt *router) Handle(pattern string, handler http.Handler) {
+	rt.patterns = append(rt.patterns, pattern)
+	rt.ServeMux.Handle(pattern, handler)
+}
+
+func (rt *router) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	rt.patterns = append(rt.patterns, pattern)
+	rt.ServeMux.HandleFunc(pattern, handler)
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpec)
+}
+
+// checkOpenAPISpec returns an error listing every registered pattern that is
+// not described in openapi.json, so the server refuses to start with a
+// stale spec.
+func checkOpenAPISpec(patterns []string) error {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		return fmt.Errorf("invalid openapi.json: %w", err)
+	}
+
+	var missing []string
+	for _, pattern := range patterns {
+		method, path, found := strings.Cut(pattern, " ")
+		if !found {
+			method, path = http.MethodGet, pattern
+		}
+
+		if !specHasOperation(spec.Paths, strings.ToLower(method), path) {
+			missing = append(missing, pattern)
+		}
+	}
+
+	if len(missing) > 0 {
+		return errors.New("routes missing from openapi.json: " + strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func specHasOperation(paths map[string]map[string]json.RawMessage, method, path string) bool {
+	// Subtree patterns such as "/app/" are documented with a trailing path
+	// parameter.
+	if strings.HasSuffix(path, "/") {
+		for specPath, operations := range paths {
+			if strings.HasPrefix(specPath, path+"{") {
+				if _, ok := operations[method]; ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	_, ok := paths[path][method]
+	return ok
+}
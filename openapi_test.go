@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testMux builds the server's routes the way main does, with throwaway
+// secrets.
+func testMux(t *testing.T) *router {
+	t.Helper()
+
+	conf := defaultConfig()
+	conf.JWTSecret = "test-secret"
+	conf.PolkaAPIKey = "test-polka-key"
+
+	jwtKeys, err := newKeyring(conf)
+	if err != nil {
+		t.Fatalf("newKeyring: %v", err)
+	}
+	guard, err := newLoginGuard(conf.LoginLockoutThreshold, conf.LoginIPLockoutThreshold, conf.LoginLockoutDuration)
+	if err != nil {
+		t.Fatalf("newLoginGuard: %v", err)
+	}
+	box, err := newSecretBox("test-totp-key")
+	if err != nil {
+		t.Fatalf("newSecretBox: %v", err)
+	}
+	mailer, err := mailers["log"](conf)
+	if err != nil {
+		t.Fatalf("log mailer: %v", err)
+	}
+
+	cfg := &apiConfig{jwtKeys: jwtKeys, polkaApiKey: conf.PolkaAPIKey}
+	verifier := &emailVerifier{mailer: mailer, ttl: conf.EmailVerificationTTL, url: conf.EmailVerificationURL}
+	return newMux(conf, cfg, guard, newTwoFactor(box), mailer, verifier)
+}
+
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	mux := testMux(t)
+	if err := checkOpenAPISpec(mux.patterns); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenAPISpecReportsMissingRoutes(t *testing.T) {
+	err := checkOpenAPISpec([]string{"GET /api/chirps", "PATCH /api/chirps/{chirpID}", "GET /api/nope"})
+	if err == nil {
+		t.Fatal("expected an error for undocumented routes")
+	}
+	for _, route := range []string{"PATCH /api/chirps/{chirpID}", "GET /api/nope"} {
+		if !strings.Contains(err.Error(), route) {
+			t.Errorf("error %q does not mention %s", err, route)
+		}
+	}
+	if strings.Contains(err.Error(), "GET /api/chirps,") {
+		t.Errorf("error %q mentions a documented route", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Delvoid/chirpy/database"
+)
+
+// hashToken is how mailed tokens are stored; only the user ever sees the
+// token itself.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// forgotPasswordHandler mails a password reset token to the user. It answers
+// 202 whether or not the email belongs to an account, and sends the mail in
+// the background so response times don't reveal it either.
+func forgotPasswordHandler(mailer Mailer, ttl time.Duration, resetURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req forgotPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		sendInBackground(r, "password reset", func(ctx context.Context) error {
+			err := sendPasswordReset(ctx, mailer, ttl, resetURL, req.Email)
+			if errors.Is(err, database.ErrUserNotFound) {
+				return nil
+			}
+			return err
+		})
+	}
+}
+
+func sendPasswordReset(ctx context.Context, mailer Mailer, ttl time.Duration, resetURL, email string) error {
+	user, err := database.GetUserByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	err = database.CreatePasswordReset(ctx, user.ID, hashToken(token), ttl)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Someone asked to reset the password for your Chirpy account.\n\n"+
+		"Your reset token is:\n\n    %s\n\n", token)
+	if resetURL != "" {
+		body += fmt.Sprintf("Or follow this link:\n\n    %s\n\n", resetURL+"?token="+url.QueryEscape(token))
+	}
+	body += fmt.Sprintf("It can be used once within %s. If you didn't ask for this, ignore this email.", ttl)
+
+	return mailer.Send(ctx, mailMessage{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body:    body,
+	})
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// resetPasswordHandler sets a new password using a mailed reset token. All
+// of the user's refresh tokens are revoked and any login lockout is lifted.
+func resetPasswordHandler(guard *loginGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req resetPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Token == "" || req.Password == "" {
+			respondWithError(w, "token and password are required", http.StatusBadRequest)
+			return
+		}
+
+		user, err := database.ResetPassword(r.Context(), hashToken(req.Token), req.Password)
+		if err != nil {
+			var policyErr *database.PasswordPolicyError
+			switch {
+			case errors.Is(err, database.ErrResetTokenInvalid):
+				respondWithError(w, "Invalid or expired reset token", http.StatusBadRequest)
+			case errors.As(err, &policyErr):
+				respondWithPasswordViolations(w, policyErr)
+			default:
+				respondWithError(w, "Failed to reset password", http.StatusInternalServerError)
+			}
+			return
+		}
+		guard.unlock(user.Email)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
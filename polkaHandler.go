@@ -19,31 +19,37 @@ func polkaWebhookHandler(polkaApiKey string) http.HandlerFunc {
 
 		authHeader := r.Header.Get("Authorization")
 		if authHeader != "ApiKey "+polkaApiKey {
+			webhookEvents.WithLabelValues("unauthorized").Inc()
 			respondWithError(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
 		var req PolkaWebhookEvent
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			webhookEvents.WithLabelValues("bad_request").Inc()
 			respondWithError(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
 		if req.Event != "user.upgraded" {
+			webhookEvents.WithLabelValues("ignored").Inc()
 			respondWithError(w, "Invalid event type", http.StatusNoContent)
 			return
 		}
 
-		err := database.UpgradeUserToChirpyRed(req.Data.UserID)
+		err := database.UpgradeUserToChirpyRed(r.Context(), req.Data.UserID)
 		if err != nil {
 			if err == database.ErrUserNotFound {
+				webhookEvents.WithLabelValues("user_not_found").Inc()
 				respondWithError(w, "User not found", http.StatusNotFound)
 			} else {
+				webhookEvents.WithLabelValues("error").Inc()
 				respondWithError(w, "Failed to upgrade user", http.StatusInternalServerError)
 			}
 			return
 		}
 
+		webhookEvents.WithLabelValues("upgraded").Inc()
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Delvoid/chirpy/database"
+)
+
+// ratePolicy allows limit requests per window, refilled continuously.
+type ratePolicy struct {
+	limit    int
+	window   time.Duration
+	redLimit int  // limit for Chirpy Red users, or 0 to use limit
+	byUser   bool // key on the authenticated user instead of the client IP
+}
+
+// rateLimitPolicies maps route patterns to their limits. Routes that are not
+// listed are not limited.
+var rateLimitPolicies = map[string]ratePolicy{
+	"POST /api/login":               {limit: 10, window: time.Minute},
+	"POST /api/login/2fa":           {limit: 10, window: time.Minute},
+	"POST /api/users":               {limit: 5, window: time.Hour},
+	"POST /api/refresh":             {limit: 30, window: time.Minute},
+	"POST /api/password/forgot":     {limit: 5, window: time.Hour},
+	"POST /api/password/reset":      {limit: 10, window: time.Minute},
+	"POST /api/users/follow":        {limit: 30, window: time.Hour, redLimit: 120, byUser: true},
+	"POST /api/chirps":              {limit: 30, window: time.Minute, redLimit: 120, byUser: true},
+	"POST /api/users/verify/resend": {limit: 5, window: time.Hour, byUser: true},
+	"POST /api/users/verify":        {limit: 10, window: time.Minute},
+	"POST /api/users/2fa/verify":    {limit: 10, window: time.Minute, byUser: true},
+	"PUT /api/users":                {limit: 10, window: time.Hour, redLimit: 30, byUser: true},
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds the token buckets for one route.
+type rateLimiter struct {
+	policy ratePolicy
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(policy ratePolicy) *rateLimiter {
+	return &rateLimiter{
+		policy:    policy,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// take spends a token from key's bucket if one is available. It returns the
+// tokens left, how long until the bucket is full again and, when the request
+// is refused, how long until a token is available.
+func (l *rateLimiter) take(key string, limit int, now time.Time) (ok bool, remaining int, reset, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate := float64(limit) / l.policy.window.Seconds()
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &tokenBucket{tokens: float64(limit), last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(float64(limit), b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		retryAfter = seconds((1 - b.tokens) / rate)
+	}
+	reset = seconds((float64(limit) - b.tokens) / rate)
+
+	l.sweep(now)
+	return ok, int(b.tokens), reset, retryAfter
+}
+
+// sweep forgets buckets that have refilled completely, since a new bucket
+// would be identical. It runs at most once per window.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.policy.window {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= l.policy.window {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// rateLimitRequests applies the policy for the matched route. Refused
+// requests get 429 with Retry-After; every limited response carries
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers.
+func rateLimitRequests(mux *router, jwtKeys *keyring, policies map[string]ratePolicy, next http.Handler) http.Handler {
+	limiters := make(map[string]*rateLimiter, len(policies))
+	for pattern, policy := range policies {
+		limiters[pattern] = newRateLimiter(policy)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		limiter, ok := limiters[pattern]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if limiter.policy.byUser {
+			r = withValidatedToken(r, jwtKeys)
+		}
+		key, limit := rateLimitKey(r, jwtKeys, limiter.policy)
+		allowed, remaining, reset, retryAfter := limiter.take(key, limit, time.Now())
+
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit, ceilSeconds(limiter.policy.window)))
+
+		if !allowed {
+			rateLimited.WithLabelValues(pattern).Inc()
+			h.Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+			respondWithError(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitKey picks the bucket for a request. Per-user policies fall back
+// to the client IP when the request has no valid access token, which the
+// handler will then reject anyway. The token is validated once, by
+// withValidatedToken, and the handler reuses the result.
+func rateLimitKey(r *http.Request, jwtKeys *keyring, policy ratePolicy) (string, int) {
+	if policy.byUser {
+		if userID, err := validateToken(r, jwtKeys); err == nil {
+			limit := policy.limit
+			if policy.redLimit > 0 {
+				if user, err := database.GetUserByID(r.Context(), userID); err == nil && user.IsChirpyRed {
+					limit = policy.redLimit
+				}
+			}
+			return "user:" + strconv.Itoa(userID), limit
+		}
+	}
+
+	return "ip:" + clientIP(r), policy.limit
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
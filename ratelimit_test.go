@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	start := time.Now()
+
+	// Each step takes a token at start+at; the policy allows 3 per minute,
+	// so a token comes back every 20 seconds.
+	steps := []struct {
+		at         time.Duration
+		ok         bool
+		remaining  int
+		retryAfter time.Duration
+	}{
+		{0, true, 2, 0},
+		{0, true, 1, 0},
+		{0, true, 0, 0},
+		{0, false, 0, 20 * time.Second},
+		{5 * time.Second, false, 0, 15 * time.Second},
+		{20 * time.Second, true, 0, 0},
+		{2 * time.Minute, true, 2, 0},
+	}
+
+	l := newRateLimiter(ratePolicy{limit: 3, window: time.Minute})
+	for i, s := range steps {
+		ok, remaining, _, retryAfter := l.take("ip:203.0.113.1", 3, start.Add(s.at))
+		if ok != s.ok || remaining != s.remaining || retryAfter.Round(time.Second) != s.retryAfter {
+			t.Errorf("step %d: got ok=%v remaining=%d retryAfter=%v, want ok=%v remaining=%d retryAfter=%v",
+				i, ok, remaining, retryAfter, s.ok, s.remaining, s.retryAfter)
+		}
+	}
+
+	if ok, _, _, _ := l.take("ip:198.51.100.7", 3, start); !ok {
+		t.Error("another key shared the exhausted bucket")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	start := time.Now()
+	l := newRateLimiter(ratePolicy{limit: 3, window: time.Minute})
+	l.lastSweep = start
+
+	l.take("ip:203.0.113.1", 3, start)
+	l.take("ip:198.51.100.7", 3, start.Add(50*time.Second))
+	l.take("ip:192.0.2.9", 3, start.Add(time.Minute))
+
+	if _, found := l.buckets["ip:203.0.113.1"]; found {
+		t.Error("refilled bucket was not swept")
+	}
+	if _, found := l.buckets["ip:198.51.100.7"]; !found {
+		t.Error("partly spent bucket was swept")
+	}
+}
+
+func TestRateLimitRequests(t *testing.T) {
+	mux := newRouter()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	mux.Handle("POST /limited", ok)
+	mux.Handle("POST /per-user", ok)
+	mux.Handle("GET /open", ok)
+
+	handler := rateLimitRequests(mux, nil, map[string]ratePolicy{
+		"POST /limited":  {limit: 2, window: time.Minute},
+		"POST /per-user": {limit: 1, window: time.Minute, byUser: true},
+	}, mux)
+
+	tests := []struct {
+		method, path, ip string
+		status           int
+		remaining        string
+	}{
+		{"POST", "/limited", "203.0.113.1", http.StatusOK, "1"},
+		{"POST", "/limited", "203.0.113.1", http.StatusOK, "0"},
+		{"POST", "/limited", "203.0.113.1", http.StatusTooManyRequests, "0"},
+		{"POST", "/limited", "198.51.100.7", http.StatusOK, "1"},
+		{"GET", "/open", "203.0.113.1", http.StatusOK, ""},
+		{"GET", "/open", "203.0.113.1", http.StatusOK, ""},
+		{"GET", "/open", "203.0.113.1", http.StatusOK, ""},
+		// Without a token, per-user routes fall back to the client IP.
+		{"POST", "/per-user", "203.0.113.1", http.StatusOK, "0"},
+		{"POST", "/per-user", "203.0.113.1", http.StatusTooManyRequests, "0"},
+		{"POST", "/per-user", "198.51.100.7", http.StatusOK, "0"},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.RemoteAddr = tt.ip + ":1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.status {
+			t.Errorf("request %d (%s %s from %s): status %d, want %d", i, tt.method, tt.path, tt.ip, rec.Code, tt.status)
+		}
+		if got := rec.Header().Get("RateLimit-Remaining"); got != tt.remaining {
+			t.Errorf("request %d: RateLimit-Remaining %q, want %q", i, got, tt.remaining)
+		}
+		retryAfter := rec.Header().Get("Retry-After")
+		if (tt.status == http.StatusTooManyRequests) != (retryAfter != "") {
+			t.Errorf("request %d: status %d with Retry-After %q", i, rec.Code, retryAfter)
+		}
+	}
+}
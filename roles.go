@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Delvoid/chirpy/database"
+)
+
+// requireRole only lets through requests carrying an access token for a
+// user with at least the given role. The role is looked up on every request
+// so demotions take effect immediately.
+func requireRole(jwtKeys *keyring, role database.Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := validateToken(r, jwtKeys)
+		if err != nil {
+			respondWithError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		user, err := database.GetUserByID(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		if !user.Role.Includes(role) {
+			respondWithError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+type roleRequest struct {
+	Role string `json:"role"`
+}
+
+func setRoleHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req roleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	role, err := database.ParseRole(req.Role)
+	if err != nil {
+		respondWithError(w, "Role must be user, moderator or admin", http.StatusBadRequest)
+		return
+	}
+
+	err = database.SetRole(r.Context(), userID, role)
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			respondWithError(w, "User not found", http.StatusNotFound)
+		} else {
+			respondWithError(w, "Failed to update role", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	respondWithJSON(w, struct {
+		ID   int           `json:"id"`
+		Role database.Role `json:"role"`
+	}{
+		ID:   userID,
+		Role: role,
+	}, http.StatusOK)
+}
+
+// bootstrapAdmin promotes the configured user to admin if there is no admin
+// yet. A missing or unverified user is not an error: they are promoted when
+// they verify their email.
+func bootstrapAdmin(ctx context.Context, email string) {
+	if email == "" {
+		return
+	}
+
+	promoted, err := database.BootstrapAdmin(ctx, email)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrEmailNotVerified):
+			log.Printf("Not promoting %s to admin until they verify their email", email)
+		case !errors.Is(err, database.ErrUserNotFound):
+			log.Printf("Failed to bootstrap admin %s: %v", email, err)
+		}
+		return
+	}
+	if promoted {
+		log.Printf("Promoted %s to admin", email)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Delvoid/chirpy/database"
+)
+
+type sessionResponse struct {
+	database.Session
+	// Current marks the session the request's access token belongs to.
+	Current bool `json:"current"`
+}
+
+func listSessionsHandler(jwtKeys *keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, claims, err := validateAccessToken(r, jwtKeys)
+		if err != nil {
+			respondWithError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		sessions, err := database.ListSessions(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, "Failed to list sessions", http.StatusInternalServerError)
+			return
+		}
+
+		resp := make([]sessionResponse, len(sessions))
+		for i, session := range sessions {
+			resp[i] = sessionResponse{
+				Session: session,
+				Current: session.ID == claims.SessionID,
+			}
+		}
+		respondWithJSON(w, resp, http.StatusOK)
+	}
+}
+
+// deleteSessionHandler revokes one of the user's sessions, such as a lost
+// device.
+func deleteSessionHandler(jwtKeys *keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := validateToken(r, jwtKeys)
+		if err != nil {
+			respondWithError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		err = database.DeleteSession(r.Context(), userID, r.PathValue("sessionID"))
+		if err != nil {
+			if errors.Is(err, database.ErrSessionNotFound) {
+				respondWithError(w, "Session not found", http.StatusNotFound)
+			} else {
+				respondWithError(w, "Failed to revoke session", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// deleteAllSessionsHandler logs the user out everywhere, invalidating every
+// refresh token and every access token issued so far, including the one
+// making the request.
+func deleteAllSessionsHandler(jwtKeys *keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := validateToken(r, jwtKeys)
+		if err != nil {
+			respondWithError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		_, err = database.EndAllSessions(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, "Failed to revoke sessions", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
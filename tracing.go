@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/Delvoid/chirpy")
+
+// traceExporters builds the span exporter selected by trace_exporter. Add an
+// entry here to send spans somewhere else.
+var traceExporters = map[string]func(conf config) (sdktrace.SpanExporter, error){
+	"stdout": func(config) (sdktrace.SpanExporter, error) {
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+	},
+	"file": func(conf config) (sdktrace.SpanExporter, error) {
+		f, err := os.OpenFile(conf.TraceFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return fileExporter{exporter, f}, nil
+	},
+}
+
+func traceExporterNames() []string {
+	names := make([]string, 0, len(traceExporters))
+	for name := range traceExporters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fileExporter closes the trace file once the exporter has flushed.
+type fileExporter struct {
+	sdktrace.SpanExporter
+	file io.Closer
+}
+
+func (e fileExporter) Shutdown(ctx context.Context) error {
+	err := e.SpanExporter.Shutdown(ctx)
+	if closeErr := e.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// setupTracing installs the global tracer provider. With no exporter
+// configured spans are never recorded. The returned function flushes
+// buffered spans.
+func setupTracing(conf config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if conf.TraceExporter == "none" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := traceExporters[conf.TraceExporter](conf)
+	if err != nil {
+		return nil, fmt.Errorf("creating %s trace exporter: %w", conf.TraceExporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("chirpy"))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// traceRequests starts a server span for every request, named after the
+// matched route pattern and continuing any trace the caller propagated.
+func traceRequests(mux *router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		_, pattern := mux.Handler(r)
+		name := pattern
+		if name == "" {
+			name = r.Method + " unmatched"
+		}
+
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(pattern),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// spanError marks span as failed with err.
+func spanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Delvoid/chirpy/database"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpIssuer = "Chirpy"
+
+	recoveryCodeCount = 10
+
+	challengeTTL         = 5 * time.Minute
+	challengeMaxAttempts = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the RFC 6238 code for a time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verifyTOTP checks a code against the current time step and one step either
+// side to allow for clock drift. It returns the matching step.
+func verifyTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	current := now.Unix() / totpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(email string, secret []byte) string {
+	query := url.Values{}
+	query.Set("secret", totpEncoding.EncodeToString(secret))
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + email,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// secretBox encrypts TOTP secrets at rest with AES-256-GCM.
+type secretBox struct {
+	aead cipher.AEAD
+	// previous only decrypt secrets sealed before a key rotation.
+	previous []cipher.AEAD
+}
+
+// newSecretBox derives the encryption key from an arbitrary string. Values
+// sealed with one of the previous keys can still be opened.
+func newSecretBox(key string, previous ...string) (*secretBox, error) {
+	aead, err := newSecretAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	box := &secretBox{aead: aead}
+	for _, key := range previous {
+		aead, err := newSecretAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		box.previous = append(box.previous, aead)
+	}
+	return box, nil
+}
+
+func newSecretAEAD(key string) (cipher.AEAD, error) {
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (b *secretBox) seal(plaintext []byte) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b.aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func (b *secretBox) open(sealed string) ([]byte, error) {
+	plaintext, err := openSealed(b.aead, sealed)
+	for _, aead := range b.previous {
+		if err == nil {
+			break
+		}
+		plaintext, err = openSealed(aead, sealed)
+	}
+	return plaintext, err
+}
+
+// reseal returns sealed encrypted with the current key, unchanged if it
+// already is.
+func (b *secretBox) reseal(sealed string) (string, error) {
+	if _, err := openSealed(b.aead, sealed); err == nil {
+		return sealed, nil
+	}
+	plaintext, err := b.open(sealed)
+	if err != nil {
+		return "", err
+	}
+	return b.seal(plaintext)
+}
+
+func openSealed(aead cipher.AEAD, sealed string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// loginChallenge is handed out by /api/login when the user has two-factor
+// authentication enabled, to be exchanged with a code at /api/login/2fa.
+type loginChallenge struct {
+	userID           int
+	expiresInSeconds int64
+	expiresAt        time.Time
+	attempts         int
+}
+
+// twoFactor holds what the two-factor handlers share. Challenges live in
+// memory only; a restart just means logging in again.
+type twoFactor struct {
+	box *secretBox
+
+	mu         sync.Mutex
+	challenges map[string]*loginChallenge
+}
+
+func newTwoFactor(box *secretBox) *twoFactor {
+	return &twoFactor{
+		box:        box,
+		challenges: make(map[string]*loginChallenge),
+	}
+}
+
+func (tf *twoFactor) newChallenge(userID int, expiresInSeconds int64) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	now := time.Now()
+	for key, c := range tf.challenges {
+		if now.After(c.expiresAt) {
+			delete(tf.challenges, key)
+		}
+	}
+	tf.challenges[token] = &loginChallenge{
+		userID:           userID,
+		expiresInSeconds: expiresInSeconds,
+		expiresAt:        now.Add(challengeTTL),
+	}
+	return token, nil
+}
+
+// attempt looks up a live challenge and counts a try against it. A
+// challenge is discarded once it has been tried too often.
+func (tf *twoFactor) attempt(token string) (loginChallenge, bool) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	c, ok := tf.challenges[token]
+	if !ok || time.Now().After(c.expiresAt) {
+		delete(tf.challenges, token)
+		return loginChallenge{}, false
+	}
+
+	c.attempts++
+	if c.attempts >= challengeMaxAttempts {
+		delete(tf.challenges, token)
+	}
+	return *c, true
+}
+
+func (tf *twoFactor) finish(token string) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	delete(tf.challenges, token)
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newRecoveryCodes returns codes to show the user once and the hashes to
+// store.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func twoFactorSetupHandler(jwtKeys *keyring, tf *twoFactor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := validateToken(r, jwtKeys)
+		if err != nil {
+			respondWithError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		user, err := database.GetUserByID(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		if user.TOTPEnabled {
+			respondWithError(w, "Two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+
+		secret := make([]byte, 20)
+		if _, err := rand.Read(secret); err != nil {
+			respondWithError(w, "Failed to generate secret", http.StatusInternalServerError)
+			return
+		}
+		sealed, err := tf.box.seal(secret)
+		if err != nil {
+			respondWithError(w, "Failed to generate secret", http.StatusInternalServerError)
+			return
+		}
+
+		err = database.SetPendingTOTP(r.Context(), userID, sealed)
+		if err != nil {
+			respondWithError(w, "Failed to save secret", http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, struct {
+			Secret     string `json:"secret"`
+			OTPAuthURI string `json:"otpauth_uri"`
+		}{
+			Secret:     totpEncoding.EncodeToString(secret),
+			OTPAuthURI: totpURI(user.Email, secret),
+		}, http.StatusOK)
+	}
+}
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+func twoFactorVerifyHandler(jwtKeys *keyring, tf *twoFactor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := validateToken(r, jwtKeys)
+		if err != nil {
+			respondWithError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		var req twoFactorCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		user, err := database.GetUserByID(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		if user.TOTPEnabled || user.TOTPSecret == "" {
+			respondWithError(w, "Start two-factor setup first", http.StatusConflict)
+			return
+		}
+
+		secret, err := tf.box.open(user.TOTPSecret)
+		if err != nil {
+			respondWithError(w, "Failed to read secret", http.StatusInternalServerError)
+			return
+		}
+		step, ok := verifyTOTP(secret, req.Code, time.Now())
+		if !ok {
+			respondWithError(w, "Invalid code", http.StatusBadRequest)
+			return
+		}
+
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			respondWithError(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+			return
+		}
+
+		err = database.EnableTOTP(r.Context(), userID, step, hashes)
+		if err != nil {
+			if errors.Is(err, database.ErrTOTPNotPending) {
+				respondWithError(w, "Start two-factor setup first", http.StatusConflict)
+			} else {
+				respondWithError(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		respondWithJSON(w, struct {
+			Enabled       bool     `json:"enabled"`
+			RecoveryCodes []string `json:"recovery_codes"`
+		}{
+			Enabled:       true,
+			RecoveryCodes: codes,
+		}, http.StatusOK)
+	}
+}
+
+type twoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code,omitempty"`
+	RecoveryCode   string `json:"recovery_code,omitempty"`
+}
+
+// loginTwoFactorHandler completes a login started at /api/login with either
+// a TOTP code or a recovery code. Wrong codes count as failed logins for the
+// account and the client IP, just like wrong passwords.
+func loginTwoFactorHandler(jwtKeys *keyring, refreshTokenTTL time.Duration, guard *loginGuard, tf *twoFactor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req twoFactorLoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if (req.Code == "") == (req.RecoveryCode == "") {
+			respondWithError(w, "Provide either code or recovery_code", http.StatusBadRequest)
+			return
+		}
+
+		challenge, ok := tf.attempt(req.ChallengeToken)
+		if !ok {
+			respondWithError(w, "Invalid or expired challenge token", http.StatusUnauthorized)
+			return
+		}
+
+		user, err := database.GetUserByID(r.Context(), challenge.userID)
+		if err != nil || !user.TOTPEnabled {
+			respondWithError(w, "Invalid or expired challenge token", http.StatusUnauthorized)
+			return
+		}
+
+		ip := clientIP(r)
+		if wait := guard.locked(user.Email, ip, time.Now()); wait > 0 {
+			tf.finish(req.ChallengeToken)
+			loginFailures.WithLabelValues("locked").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+			respondWithError(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		if req.RecoveryCode != "" {
+			err = database.UseRecoveryCode(r.Context(), user.ID, hashRecoveryCode(req.RecoveryCode))
+		} else {
+			err = checkTOTPLogin(r, tf, user, req.Code)
+		}
+		if err != nil {
+			loginFailures.WithLabelValues("wrong_second_factor").Inc()
+			sleep(r.Context(), guard.fail(user.Email, ip, time.Now()))
+			respondWithError(w, "Invalid code", http.StatusUnauthorized)
+			return
+		}
+		tf.finish(req.ChallengeToken)
+		guard.succeed(user.Email)
+
+		issueTokens(w, r, jwtKeys, user, challenge.expiresInSeconds, refreshTokenTTL)
+	}
+}
+
+func checkTOTPLogin(r *http.Request, tf *twoFactor, user database.User, code string) error {
+	secret, err := tf.box.open(user.TOTPSecret)
+	if err != nil {
+		return err
+	}
+	step, ok := verifyTOTP(secret, code, time.Now())
+	if !ok {
+		return errors.New("invalid code")
+	}
+	return database.UseTOTPStep(r.Context(), user.ID, step)
+}
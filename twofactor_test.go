@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA-1 vectors from RFC 6238 appendix B, truncated to six digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(rfc6238Secret, tt.unix/totpPeriod); got != tt.code {
+			t.Errorf("T=%d: code %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name string
+		code string
+		ok   bool
+		step int64
+	}{
+		{"current step", totpCode(rfc6238Secret, current), true, current},
+		{"previous step", totpCode(rfc6238Secret, current-1), true, current - 1},
+		{"next step", totpCode(rfc6238Secret, current+1), true, current + 1},
+		{"spaces ignored", "005 924", true, current},
+		{"two steps old", totpCode(rfc6238Secret, current-2), false, 0},
+		{"two steps ahead", totpCode(rfc6238Secret, current+2), false, 0},
+		{"wrong code", "000000", false, 0},
+		{"empty", "", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := verifyTOTP(rfc6238Secret, tt.code, now)
+			if ok != tt.ok || step != tt.step {
+				t.Errorf("verifyTOTP(%q) = %d, %v; want %d, %v", tt.code, step, ok, tt.step, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSecretBoxRotation(t *testing.T) {
+	old, err := newSecretBox("old-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedOld, err := old.seal(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := newSecretBox("new-key", "old-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedNew, err := rotated.seal(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unrelated, err := newSecretBox("new-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		box    *secretBox
+		sealed string
+		ok     bool
+	}{
+		{"same key", old, sealedOld, true},
+		{"previous key", rotated, sealedOld, true},
+		{"current key", rotated, sealedNew, true},
+		{"old key dropped", unrelated, sealedOld, false},
+		{"newer key unknown", old, sealedNew, false},
+		{"tampered", rotated, sealedNew[:len(sealedNew)-4] + "AAAA", false},
+		{"too short", rotated, "AAAA", false},
+		{"not base64", rotated, "not base64!", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext, err := tt.box.open(tt.sealed)
+			if ok := err == nil; ok != tt.ok {
+				t.Fatalf("open: err = %v, want ok = %v", err, tt.ok)
+			}
+			if tt.ok && string(plaintext) != string(rfc6238Secret) {
+				t.Errorf("open = %q, want %q", plaintext, rfc6238Secret)
+			}
+		})
+	}
+
+	resealed, err := rotated.reseal(sealedOld)
+	if err != nil {
+		t.Fatalf("reseal: %v", err)
+	}
+	if plaintext, err := unrelated.open(resealed); err != nil || string(plaintext) != string(rfc6238Secret) {
+		t.Errorf("resealed value does not open with the new key alone: %q, %v", plaintext, err)
+	}
+	if again, err := rotated.reseal(sealedNew); err != nil || again != sealedNew {
+		t.Errorf("reseal changed a value already sealed with the current key: %v", err)
+	}
+}
+
+func TestLoginChallengeAttempts(t *testing.T) {
+	tf := newTwoFactor(nil)
+	token, err := tf.newChallenge(7, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= challengeMaxAttempts; i++ {
+		c, ok := tf.attempt(token)
+		if !ok {
+			t.Fatalf("attempt %d: challenge gone", i)
+		}
+		if c.userID != 7 || c.expiresInSeconds != 3600 || c.attempts != i {
+			t.Errorf("attempt %d: got %+v", i, c)
+		}
+	}
+	if _, ok := tf.attempt(token); ok {
+		t.Error("challenge still usable after the maximum number of attempts")
+	}
+
+	token, err = tf.newChallenge(7, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf.finish(token)
+	if _, ok := tf.attempt(token); ok {
+		t.Error("challenge still usable after finish")
+	}
+
+	token, err = tf.newChallenge(7, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf.challenges[token].expiresAt = time.Now().Add(-time.Second)
+	if _, ok := tf.attempt(token); ok {
+		t.Error("expired challenge accepted")
+	}
+
+	if _, ok := tf.attempt("unknown"); ok {
+		t.Error("unknown challenge accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		if seen[code] {
+			t.Errorf("duplicate code %s", code)
+		}
+		seen[code] = true
+		if hashes[i] != hashRecoveryCode(code) {
+			t.Errorf("hash %d does not match code %s", i, code)
+		}
+		// Users may retype the code without the dash, in capitals or
+		// with stray whitespace.
+		for _, typed := range []string{strings.ToUpper(code), strings.ReplaceAll(code, "-", ""), " " + code + "\n"} {
+			if hashRecoveryCode(typed) != hashes[i] {
+				t.Errorf("%q does not match code %s", typed, code)
+			}
+		}
+	}
+}
@@ -1,13 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
-	"strconv"
-	"strings"
 
 	"github.com/Delvoid/chirpy/database"
-	"github.com/dgrijalva/jwt-go"
 )
 
 type userRequest struct {
@@ -15,66 +14,76 @@ type userRequest struct {
 	Password string `json:"password"`
 }
 
-func createUserHandler(w http.ResponseWriter, r *http.Request) {
-	resBody := userRequest{}
-
-	if err := json.NewDecoder(r.Body).Decode(&resBody); err != nil {
-		respondWithError(w, "Invalid request body", http.StatusBadRequest)
-		defer r.Body.Close()
-		return
-	}
-	defer r.Body.Close()
-
-	user, err := database.CreateUser(resBody.Email, resBody.Password)
-	if err != nil {
-		respondWithError(w, err.Error(), http.StatusBadRequest)
-		return
+// userResponse is how a user's own account is shown to them.
+func userResponse(user database.User) interface{} {
+	return struct {
+		ID           int    `json:"id"`
+		Email        string `json:"email"`
+		IsChirpyRed  bool   `json:"is_chirpy_red"`
+		Verified     bool   `json:"verified"`
+		PendingEmail string `json:"pending_email,omitempty"`
+	}{
+		ID:           user.ID,
+		Email:        user.Email,
+		IsChirpyRed:  user.IsChirpyRed,
+		Verified:     user.Verified,
+		PendingEmail: user.PendingEmail,
 	}
+}
 
+// respondWithPasswordViolations lists every password rule that was broken.
+func respondWithPasswordViolations(w http.ResponseWriter, err *database.PasswordPolicyError) {
 	respondWithJSON(w, struct {
-		ID          int    `json:"id"`
-		Email       string `json:"email"`
-		IsChirpyRed bool   `json:"is_chirpy_red"`
+		Error      string                       `json:"error"`
+		Violations []database.PasswordViolation `json:"violations"`
 	}{
-		ID:          user.ID,
-		Email:       user.Email,
-		IsChirpyRed: user.IsChirpyRed,
-	}, http.StatusCreated)
-
+		Error:      "Password does not meet the requirements",
+		Violations: err.Violations,
+	}, http.StatusBadRequest)
 }
 
-func updateUserHandler(jwtSecret string) http.HandlerFunc {
+func createUserHandler(verifier *emailVerifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPut {
-			respondWithError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		resBody := userRequest{}
+
+		if err := json.NewDecoder(r.Body).Decode(&resBody); err != nil {
+			respondWithError(w, "Invalid request body", http.StatusBadRequest)
+			defer r.Body.Close()
 			return
 		}
+		defer r.Body.Close()
 
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
-			respondWithError(w, "Missing Authorization header", http.StatusUnauthorized)
+		user, err := database.CreateUser(r.Context(), resBody.Email, resBody.Password)
+		if err != nil {
+			var policyErr *database.PasswordPolicyError
+			if errors.As(err, &policyErr) {
+				respondWithPasswordViolations(w, policyErr)
+			} else {
+				respondWithError(w, err.Error(), http.StatusBadRequest)
+			}
 			return
 		}
 
-		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
-		claims := &jwt.StandardClaims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(jwtSecret), nil
+		sendInBackground(r, "email verification", func(ctx context.Context) error {
+			return verifier.send(ctx, user.ID, user.Email)
 		})
 
-		if err != nil {
-			respondWithError(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
+		respondWithJSON(w, userResponse(user), http.StatusCreated)
+	}
+}
 
-		if !token.Valid {
-			respondWithError(w, "Invalid token", http.StatusUnauthorized)
+// updateUserHandler changes the password right away. A new email only takes
+// effect once the user confirms it from the verification mail.
+func updateUserHandler(jwtKeys *keyring, verifier *emailVerifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			respondWithError(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		userID, err := strconv.Atoi(claims.Subject)
+		userID, err := validateToken(r, jwtKeys)
 		if err != nil {
-			respondWithError(w, "Invalid user ID", http.StatusUnauthorized)
+			respondWithError(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
@@ -85,18 +94,28 @@ func updateUserHandler(jwtSecret string) http.HandlerFunc {
 		}
 		defer r.Body.Close()
 
-		user, err := database.UpdateUser(userID, req.Email, req.Password)
+		user, err := database.UpdateUser(r.Context(), userID, req.Email, req.Password)
 		if err != nil {
-			respondWithError(w, err.Error(), http.StatusInternalServerError)
+			var policyErr *database.PasswordPolicyError
+			switch {
+			case errors.As(err, &policyErr):
+				respondWithPasswordViolations(w, policyErr)
+			case errors.Is(err, database.ErrInvalidEmail):
+				respondWithError(w, err.Error(), http.StatusBadRequest)
+			case errors.Is(err, database.ErrUserExists):
+				respondWithError(w, "Email is already in use", http.StatusConflict)
+			default:
+				respondWithError(w, err.Error(), http.StatusInternalServerError)
+			}
 			return
 		}
 
-		respondWithJSON(w, struct {
-			ID    int    `json:"id"`
-			Email string `json:"email"`
-		}{
-			ID:    user.ID,
-			Email: user.Email,
-		}, http.StatusOK)
+		if req.Email != "" && user.PendingEmail != "" {
+			sendInBackground(r, "email verification", func(ctx context.Context) error {
+				return verifier.send(ctx, user.ID, user.PendingEmail)
+			})
+		}
+
+		respondWithJSON(w, userResponse(user), http.StatusOK)
 	}
 }